@@ -0,0 +1,212 @@
+package dcdn
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+)
+
+//content-defined chunking parameters (FastCDC with normalized chunking)
+const (
+	cdcMin = 2 * 1024  //minimum chunk size
+	cdcAvg = 8 * 1024  //target average chunk size
+	cdcMax = 64 * 1024 //maximum chunk size
+
+	cdcMaskS = 0x0003590703530000 //mask used below the average size (harder to match)
+	cdcMaskL = 0x0000d90003530000 //mask used above the average size (easier to match)
+)
+
+//gear table for the rolling hash (derived from sha256 so that it is stable)
+var cdcGear [256]uint64
+
+func init() {
+	for i := range cdcGear {
+		s := sha256.Sum256([]byte{byte(i)})
+		cdcGear[i] = binary.LittleEndian.Uint64(s[:])
+	}
+}
+
+//cdcCut finds the length of the first chunk in dat
+func cdcCut(dat []byte) int {
+	n := len(dat)
+	if n <= cdcMin {
+		return n
+	}
+	if n > cdcMax {
+		n = cdcMax
+	}
+	normal := cdcAvg
+	if n < normal {
+		normal = n
+	}
+	var fp uint64
+	i := cdcMin
+	for ; i < normal; i++ {
+		fp = (fp << 1) + cdcGear[dat[i]]
+		if fp&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + cdcGear[dat[i]]
+		if fp&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+//Chunk is a content-defined chunk of an object
+type Chunk struct {
+	Hash   Hash   `json:"hash"`   //hash of the chunk data (including the chunk length)
+	Offset uint64 `json:"offset"` //offset of the chunk in the object
+}
+
+//ChunkList is the list of chunks which make up an object
+type ChunkList struct {
+	Chunks []Chunk `json:"chunks"`
+}
+
+//chunkWriter is an io.Writer which splits data into chunks
+type chunkWriter struct {
+	hashtype string
+	hf       func() hash.Hash
+	buf      []byte
+	off      uint64
+	chunks   []Chunk
+}
+
+func newChunkWriter(hashtype string) (*chunkWriter, error) {
+	hf := hashFunc(hashtype)
+	if hf == nil {
+		return nil, ErrUnrecognizedHash
+	}
+	return &chunkWriter{
+		hashtype: hashtype,
+		hf:       hf,
+		buf:      make([]byte, 0, 2*cdcMax),
+	}, nil
+}
+
+//emit hashes and records a chunk
+func (cw *chunkWriter) emit(dat []byte) {
+	h := cw.hf()
+	h.Write(dat)
+	cw.chunks = append(cw.chunks, Chunk{
+		Hash: Hash{
+			HashType: cw.hashtype,
+			Hash:     h.Sum(nil),
+			Len:      uint64(len(dat)),
+		},
+		Offset: cw.off,
+	})
+	cw.off += uint64(len(dat))
+}
+
+func (cw *chunkWriter) Write(dat []byte) (int, error) {
+	cw.buf = append(cw.buf, dat...)
+	//only cut when a full window is available so that boundaries do not depend on write sizes
+	start := 0
+	for len(cw.buf)-start >= cdcMax {
+		c := cdcCut(cw.buf[start:])
+		cw.emit(cw.buf[start : start+c])
+		start += c
+	}
+	cw.buf = cw.buf[:copy(cw.buf, cw.buf[start:])]
+	return len(dat), nil
+}
+
+//list finishes chunking and returns the chunk list
+func (cw *chunkWriter) list() *ChunkList {
+	for len(cw.buf) > 0 {
+		c := cdcCut(cw.buf)
+		cw.emit(cw.buf[:c])
+		cw.buf = cw.buf[c:]
+	}
+	return &ChunkList{Chunks: cw.chunks}
+}
+
+//GenChunkList reads data from r and splits it into content-defined chunks
+//the chunks and the whole object are hashed with the given hash type
+func GenChunkList(hashtype string, r io.Reader) (*ChunkList, *Hash, error) {
+	cw, err := newChunkWriter(hashtype)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := cw.hf()
+	n, err := io.Copy(io.MultiWriter(cw, h), r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cw.list(), &Hash{
+		HashType: hashtype,
+		Hash:     h.Sum(nil),
+		Len:      uint64(n),
+	}, nil
+}
+
+//ErrBadChunkList is an error returned when a chunk list is not consistent with an object
+var ErrBadChunkList = errors.New("Chunk list does not match object")
+
+//Check checks that the chunks are contiguous and cover an object with a hash of h
+//the chunk hashes can only be fully validated by verifying the assembled object against h
+func (cl *ChunkList) Check(h Hash) error {
+	var off uint64
+	for _, c := range cl.Chunks {
+		if c.Offset != off || c.Hash.Len == 0 || c.Hash.Len > cdcMax {
+			return ErrBadChunkList
+		}
+		if hashFunc(c.Hash.HashType) == nil {
+			return ErrUnrecognizedHash
+		}
+		off += c.Hash.Len
+	}
+	if off != h.Len {
+		return ErrBadChunkList
+	}
+	return nil
+}
+
+//ErrChunkMissing is an error returned by a ChunkStore when it does not have a chunk
+var ErrChunkMissing = errors.New("Chunk not in store")
+
+//ChunkStore is an interface for a system that stores verified chunks
+type ChunkStore interface {
+	GetChunk(Hash) ([]byte, error) //returns ErrChunkMissing if the chunk is not stored
+	PutChunk(Hash, []byte) error   //stores a chunk (the data has already been verified)
+}
+
+//MemChunkStore is a ChunkStore which keeps chunks in memory
+type MemChunkStore struct {
+	lck    sync.RWMutex
+	chunks map[string][]byte
+}
+
+//NewMemChunkStore creates a new MemChunkStore
+func NewMemChunkStore() *MemChunkStore {
+	return &MemChunkStore{
+		chunks: make(map[string][]byte),
+	}
+}
+
+//GetChunk gets a chunk from the store
+func (ms *MemChunkStore) GetChunk(h Hash) ([]byte, error) {
+	ms.lck.RLock()
+	defer ms.lck.RUnlock()
+	dat, ok := ms.chunks[h.String()]
+	if !ok {
+		return nil, ErrChunkMissing
+	}
+	return dat, nil
+}
+
+//PutChunk adds a chunk to the store
+func (ms *MemChunkStore) PutChunk(h Hash, dat []byte) error {
+	ms.lck.Lock()
+	defer ms.lck.Unlock()
+	ms.chunks[h.String()] = dat
+	return nil
+}
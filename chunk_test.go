@@ -0,0 +1,157 @@
+package dcdn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestChunkList(t *testing.T) {
+	//generate pseudo-random data
+	d := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(d)
+	cl, h, err := GenChunkList("sha256", bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("Failed to generate chunk list: %q\n", err.Error())
+	}
+	if h.String() != quickHash(t, d).String() {
+		t.Fatalf("Object hash mismatch: %q\n", h.String())
+	}
+	err = cl.Check(*h)
+	if err != nil {
+		t.Fatalf("Chunk list check failed: %q\n", err.Error())
+	}
+	//chunk sizes must be within bounds
+	for i, c := range cl.Chunks {
+		if c.Hash.Len > cdcMax || (c.Hash.Len < cdcMin && i != len(cl.Chunks)-1) {
+			t.Fatalf("Chunk %d has bad size %d\n", i, c.Hash.Len)
+		}
+		if c.Hash.String() != quickHash(t, d[c.Offset:c.Offset+c.Hash.Len]).String() {
+			t.Fatalf("Chunk %d hash mismatch\n", i)
+		}
+	}
+	//insert some data near the start - most chunks should be shared
+	d2 := append(append(append([]byte(nil), d[:1000]...), []byte("inserted data")...), d[1000:]...)
+	cl2, h2, err := GenChunkList("sha256", bytes.NewReader(d2))
+	if err != nil {
+		t.Fatalf("Failed to generate chunk list: %q\n", err.Error())
+	}
+	err = cl2.Check(*h2)
+	if err != nil {
+		t.Fatalf("Chunk list check failed: %q\n", err.Error())
+	}
+	old := make(map[string]bool)
+	for _, c := range cl.Chunks {
+		old[c.Hash.String()] = true
+	}
+	shared := 0
+	for _, c := range cl2.Chunks {
+		if old[c.Hash.String()] {
+			shared++
+		}
+	}
+	if shared < len(cl2.Chunks)-3 {
+		t.Fatalf("Only %d/%d chunks shared after insert\n", shared, len(cl2.Chunks))
+	}
+	//tampered chunk list
+	cl.Chunks[1].Offset++
+	if cl.Check(*h) != ErrBadChunkList {
+		t.Fatal("Expected bad chunk list error\n")
+	}
+}
+
+func TestMemChunkStore(t *testing.T) {
+	ms := NewMemChunkStore()
+	h := quickHash(t, []byte("chunk"))
+	_, err := ms.GetChunk(h)
+	if err != ErrChunkMissing {
+		t.Fatalf("Expected chunk missing error but got %v\n", err)
+	}
+	err = ms.PutChunk(h, []byte("chunk"))
+	if err != nil {
+		t.Fatalf("Failed to store chunk: %q\n", err.Error())
+	}
+	dat, err := ms.GetChunk(h)
+	if err != nil || string(dat) != "chunk" {
+		t.Fatalf("Failed to load chunk: %v\n", err)
+	}
+}
+
+func TestGetChunked(t *testing.T) {
+	d := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(2)).Read(d)
+	dir, err := ioutil.TempDir("", "dcdnchunk")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file"), d, 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	//count the chunks which are requested from the origin
+	var chunkReqs int64
+	fsrv := FileServer{HashCache: hc, ErrLogger: func(error) {}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-DCDN-CHUNK") != "" {
+			atomic.AddInt64(&chunkReqs, 1)
+		}
+		fsrv.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	//the cache does not have any chunks, so they are loaded from the origin
+	var cacheReqs int64
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("chunk") == "true" {
+			atomic.AddInt64(&cacheReqs, 1)
+		}
+		http.NotFound(w, r)
+	}))
+	defer cache.Close()
+	cu, _ := url.Parse(cache.URL)
+	cli := NewClient()
+	defer cli.Close()
+	cli.SetSelector(StaticSelector{cu})
+	su, _ := url.Parse(srv.URL + "/file")
+	store := NewMemChunkStore()
+	get := func(dat []byte) int64 {
+		atomic.StoreInt64(&chunkReqs, 0)
+		rc, err := cli.GetChunked(su, quickHash(t, dat), store)
+		if err != nil {
+			t.Fatalf("Failed to start chunked download: %q\n", err.Error())
+		}
+		defer rc.Close()
+		body, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("Chunked download failed: %q\n", err.Error())
+		}
+		if !bytes.Equal(body, dat) {
+			t.Fatal("Chunked download returned wrong content\n")
+		}
+		return atomic.LoadInt64(&chunkReqs)
+	}
+	cl, _, err := GenChunkList("sha256", bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("Failed to generate chunk list: %q\n", err.Error())
+	}
+	if n := get(d); n != int64(len(cl.Chunks)) || atomic.LoadInt64(&cacheReqs) != n {
+		t.Fatalf("Expected %d chunk requests but got %d (%d from the cache)\n", len(cl.Chunks), n, cacheReqs)
+	}
+	//a second version with a small insert only needs the changed chunks
+	d2 := append(append(append([]byte(nil), d[:300000]...), []byte("inserted")...), d[300000:]...)
+	tmp := filepath.Join(dir, "tmp")
+	ioutil.WriteFile(tmp, d2, 0600)
+	os.Rename(tmp, filepath.Join(dir, "file"))
+	if n := get(d2); n < 1 || n > 2 {
+		t.Fatalf("Expected 1 or 2 chunk requests for the second version but got %d\n", n)
+	}
+}
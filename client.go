@@ -1,9 +1,15 @@
 package dcdn
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 )
 
@@ -19,6 +25,7 @@ type Client struct {
 	lck    sync.RWMutex
 	ss     ServerSelector
 	hcl    *http.Client
+	keys   []ed25519.PublicKey
 	closed bool
 }
 
@@ -39,9 +46,42 @@ func (c *Client) SetHTTPClient(cli *http.Client) {
 	}
 	c.lck.Lock()
 	defer c.lck.Unlock()
-	c.hcl = cli
+	c.hcl = noCacheRedirects(cli)
 }
 
+//noCacheRedirects returns a copy of an http client which does not follow redirects from an origin to a cache (the Client handles them itself)
+func noCacheRedirects(cli *http.Client) *http.Client {
+	ncli := new(http.Client)
+	*ncli = *cli
+	ncli.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.Response != nil && req.Response.Header.Get("X-DCDN-HASH") != "" {
+			return http.ErrUseLastResponse
+		}
+		if cli.CheckRedirect != nil {
+			return cli.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 { //default policy
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	return ncli
+}
+
+//StaticSelector is a ServerSelector which always selects the same servers
+type StaticSelector []*url.URL
+
+//SelectServers implements ServerSelector
+func (s StaticSelector) SelectServers() []*url.URL {
+	return s
+}
+
+//ReportFailure implements ServerSelector (the list is not changed)
+func (s StaticSelector) ReportFailure(*url.URL) {}
+
+//Close implements ServerSelector
+func (s StaticSelector) Close() {}
+
 func (c *Client) getServers() ([]*url.URL, *http.Client) {
 	c.lck.RLock()
 	defer c.lck.RUnlock()
@@ -61,7 +101,20 @@ func (c *Client) Get(u *url.URL) (o *http.Response, h *Hash, err error) {
 	return c.GetReq(req)
 }
 
+//Head loads the headers of an object and its hash without downloading the content
+//the hash is nil if the server does not provide one
+func (c *Client) Head(u *url.URL) (o *http.Response, h *Hash, err error) {
+	req, err := http.NewRequest(http.MethodHead, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.GetReq(req)
+}
+
 //GetReq sends a request for content and returns an io.ReadCloser from which the content may be read
+//if the request has a Range header, the returned hash is the hash of the full object (use GetRange to get a verified range)
+//if the request has no Accept-Encoding header, gzip-encoded responses are decompressed after the encoded bytes are verified against h (resp.Uncompressed is set, and h is the hash of the encoded bytes)
+//the encoded body is read in full (in a temporary file if it is large) before GetReq returns, so a mismatch is returned as an error
 func (c *Client) GetReq(req *http.Request) (o *http.Response, h *Hash, err error) {
 	if c.closed {
 		err = errors.New("Client closed")
@@ -70,57 +123,529 @@ func (c *Client) GetReq(req *http.Request) (o *http.Response, h *Hash, err error
 	//send request to server
 	srvs, hcl := c.getServers()
 	req.Header.Add("X-DCDN", "client")
+	//negotiate the encoding instead of the http.Transport so that the encoded bytes can be verified
+	decode := false
+	if req.Header.Get("Accept-Encoding") == "" && req.Header.Get("Range") == "" && req.Method != http.MethodHead {
+		req.Header.Set("Accept-Encoding", "gzip")
+		decode = true
+	}
 	resp, err := hcl.Do(req)
 	if err != nil {
 		return
 	}
 	defer func() {
-		if resp == o {
+		if resp != nil && resp != o {
 			resp.Body.Close()
 		}
 	}()
-	if srvs != nil && resp.Header.Get("X-DCDN") == "server" {
-		ha := resp.Header.Get("X-DCDN-HASH")
-		h, err = ParseHash(ha) //load hash
-		if err != nil {
-			//use cache
-			for _, s := range srvs {
-				//build request URL
-				su := new(url.URL)
-				*su = *s
-				su.Query().Add("hash", ha)
-				su.Query().Add("url", req.URL.String())
-				//send request
-				var g *http.Response
-				g, err = http.Get(su.String()) //attempt get request
-				if err != nil || g.Header.Get("X-DCDN") != "cache" {
-					//if it failed, or if the endpoint is not running DCDN, dont use this anymore
-					func() {
-						c.lck.RLock()
-						defer c.lck.RUnlock()
-						c.ss.ReportFailure(s)
-					}()
-					continue
-				}
-				//copy headers from origin server
-				g.Header = resp.Header
-				//set output and return
-				o = g
-				err = nil
+	//load hash (the strongest supported one if several are advertised)
+	h, err = c.responseHash(resp, req.URL)
+	if err != nil {
+		h = nil
+		return
+	}
+	o = resp
+	//other statuses (e.g. 304 or 412) describe the request and are returned as they are
+	usable := resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusTemporaryRedirect
+	if h != nil && usable && req.Method != http.MethodHead && resp.Header.Get("X-DCDN") == "server" {
+		//the origin may send the client to a cache instead of sending the content
+		redirected := resp.StatusCode == http.StatusTemporaryRedirect
+		enc := resp.Header.Get("Content-Encoding")
+		recommended := 0
+		if redirected {
+			rc := headerCaches(resp.Header)
+			srvs, recommended = append(rc, srvs...), len(rc) //try the recommended caches first
+			enc = resp.Header.Get("X-DCDN-Encoding")
+		}
+		//use cache
+		var g *http.Response
+		if len(srvs) > 0 {
+			q := url.Values{
+				"hash": {h.String()},
+				"url":  {req.URL.String()},
+			}
+			if enc != "" {
+				q.Set("encoding", enc)
+			}
+			g = c.tryCaches(srvs, recommended, hcl, q, req.Header.Get("Range"))
+		}
+		switch {
+		case g != nil && redirected:
+			o = g
+		case g != nil:
+			//copy headers from origin server
+			g.Header = resp.Header
+			o = g
+		case redirected:
+			//no cache worked - ask the origin to send the content itself
+			req = req.Clone(req.Context())
+			req.Header.Set("X-DCDN-NOREDIRECT", "true")
+			resp.Body.Close()
+			o, resp = nil, nil
+			resp, err = hcl.Do(req)
+			if err != nil {
+				h = nil
+				return
+			}
+			h, err = c.responseHash(resp, req.URL)
+			if err != nil {
+				h = nil
 				return
 			}
+			o = resp
+		}
+		//otherwise fallback to direct download
+	}
+	if decode && o.Header.Get("Content-Encoding") == "gzip" {
+		err = decodeResponse(o, h)
+		if err != nil {
+			if o != resp {
+				o.Body.Close()
+			}
+			o, h = nil, nil
 		}
-		//fallback to direct download
 	}
-	//load hash
-	ha := resp.Header.Get("X-DCDN-HASH")
-	h, _ = ParseHash(ha)
-	//process request
-	o = resp
-	err = nil
 	return
 }
 
+//HeaderHashes parses the X-DCDN-HASH headers (repeated headers or comma-separated lists)
+//the returned slices are aligned - entries which fail to parse are nil, and missing signatures are empty
+func HeaderHashes(hdr http.Header) ([]*Hash, []string) {
+	var hashes []*Hash
+	for _, v := range hdr.Values("X-DCDN-HASH") {
+		for _, str := range strings.Split(v, ",") {
+			h, _ := ParseHash(strings.TrimSpace(str))
+			hashes = append(hashes, h)
+		}
+	}
+	sigs := make([]string, len(hashes))
+	i := 0
+	for _, v := range hdr.Values("X-DCDN-Signature") {
+		for _, str := range strings.Split(v, ",") {
+			if i < len(sigs) {
+				sigs[i] = strings.TrimSpace(str)
+			}
+			i++
+		}
+	}
+	return hashes, sigs
+}
+
+//headerCaches parses the X-DCDN-Cache headers of a redirect from an origin
+func headerCaches(hdr http.Header) []*url.URL {
+	var srvs []*url.URL
+	for _, v := range hdr.Values("X-DCDN-Cache") {
+		u, err := url.Parse(v)
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			srvs = append(srvs, u)
+		}
+	}
+	return srvs
+}
+
+//responseHash picks the strongest hash of a response and checks its signature
+func (c *Client) responseHash(resp *http.Response, u *url.URL) (*Hash, error) {
+	hashes, sigs := HeaderHashes(resp.Header)
+	h := StrongestHash(hashes)
+	if h == nil {
+		return nil, nil
+	}
+	for i, v := range hashes {
+		if v == h {
+			err := c.checkSignature(sigs[i], *h, u)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return h, nil
+}
+
+//ResponseHashes returns the hashes advertised by a response which have valid signatures for the URL (all of them if no origin keys are set)
+//GetReq only checks the signature of the hash it picks, so this should be used before trusting any of the others
+func (c *Client) ResponseHashes(resp *http.Response, u *url.URL) []*Hash {
+	hashes, sigs := HeaderHashes(resp.Header)
+	var signed []*Hash
+	for i, h := range hashes {
+		if h != nil && c.checkSignature(sigs[i], *h, u) == nil {
+			signed = append(signed, h)
+		}
+	}
+	return signed
+}
+
+//tryCaches sends a request with the given query (and optional Range header) to each cache server until one succeeds
+//the first recommended servers were recommended by the origin rather than selected by the ServerSelector
+func (c *Client) tryCaches(srvs []*url.URL, recommended int, hcl *http.Client, query url.Values, rng string) *http.Response {
+	for i, s := range srvs {
+		//send request
+		req, err := http.NewRequest(http.MethodGet, cacheURL(s, query).String(), nil)
+		if err != nil {
+			continue
+		}
+		if rng != "" {
+			req.Header.Set("Range", rng)
+		}
+		//the cache must send the encoded bytes as they are
+		enc := query.Get("encoding")
+		if enc == "" {
+			enc = "identity"
+		}
+		req.Header.Set("Accept-Encoding", enc)
+		g, err := hcl.Do(req) //attempt get request
+		ok := err == nil && (g.StatusCode == http.StatusOK || (rng != "" && g.StatusCode == http.StatusPartialContent))
+		if !ok || g.Header.Get("X-DCDN") != "cache" {
+			if err == nil {
+				g.Body.Close()
+			}
+			//if it failed, or if the endpoint is not running DCDN, dont use this anymore
+			//(the selector is not told about caches it did not select)
+			func() {
+				c.lck.RLock()
+				defer c.lck.RUnlock()
+				if c.ss != nil && i >= recommended {
+					c.ss.ReportFailure(s)
+				}
+			}()
+			continue
+		}
+		return g
+	}
+	return nil
+}
+
+//SetOriginKeys sets the keys trusted to sign hashes (if any are set, all received hashes must have valid signatures)
+func (c *Client) SetOriginKeys(keys ...ed25519.PublicKey) {
+	if c.closed {
+		panic(errors.New("Attempted to set origin keys on a closed client"))
+	}
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.keys = keys
+}
+
+//checkSignature checks a hash signature (if origin keys are set)
+func (c *Client) checkSignature(sig string, h Hash, u *url.URL) error {
+	c.lck.RLock()
+	defer c.lck.RUnlock()
+	if len(c.keys) == 0 {
+		return nil
+	}
+	return VerifyHashSignature(c.keys, sig, h, u)
+}
+
+//GetBlocks loads the block list of a merkle-hashed object from the origin and checks it against h
+func (c *Client) GetBlocks(u *url.URL, h Hash) (*BlockList, error) {
+	if c.closed {
+		return nil, errors.New("Client closed")
+	}
+	_, hcl := c.getServers()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-DCDN", "client")
+	req.Header.Add("X-DCDN-BLOCKS", "true")
+	resp, err := hcl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("block list request failed with status %q", resp.Status)
+	}
+	bl := new(BlockList)
+	err = json.NewDecoder(resp.Body).Decode(bl)
+	if err != nil {
+		return nil, err
+	}
+	err = bl.Check(h)
+	if err != nil {
+		return nil, err
+	}
+	return bl, nil
+}
+
+//GetChunked downloads an object with a hash of h by content-defined chunks
+//chunks already in the store are not downloaded, and downloaded chunks are added to the store
+//the returned reader verifies the assembled object against h
+func (c *Client) GetChunked(u *url.URL, h Hash, store ChunkStore) (io.ReadCloser, error) {
+	if c.closed {
+		return nil, errors.New("Client closed")
+	}
+	_, hcl := c.getServers()
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("X-DCDN", "client")
+	req.Header.Add("X-DCDN-CHUNKS", "true")
+	resp, err := hcl.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("chunk list request failed with status %q", resp.Status)
+	}
+	found := false
+	hashes, _ := HeaderHashes(resp.Header)
+	for _, v := range hashes {
+		if v != nil && v.String() == h.String() {
+			found = true
+		}
+	}
+	if !found {
+		return nil, ErrBadChunkList
+	}
+	cl := new(ChunkList)
+	err = json.NewDecoder(resp.Body).Decode(cl)
+	if err != nil {
+		return nil, err
+	}
+	err = cl.Check(h)
+	if err != nil {
+		return nil, err
+	}
+	return h.NewVerifyingReader(&chunkReader{
+		c:     c,
+		u:     u,
+		cl:    cl,
+		store: store,
+	})
+}
+
+//BlobURL gets the URL of a file with the given hash on a DCDN origin server
+func BlobURL(origin *url.URL, h Hash) *url.URL {
+	return origin.ResolveReference(&url.URL{Path: BlobPrefix + h.String()})
+}
+
+//GetBlob loads a file by hash from any DCDN origin (through a cache if possible)
+//the returned reader verifies the content against h
+func (c *Client) GetBlob(origin *url.URL, h Hash) (io.ReadCloser, error) {
+	if c.closed {
+		return nil, errors.New("Client closed")
+	}
+	srvs, hcl := c.getServers()
+	bu := BlobURL(origin, h)
+	resp := c.tryCaches(srvs, 0, hcl, url.Values{
+		"hash": {h.String()},
+		"url":  {bu.String()},
+	}, "")
+	if resp == nil {
+		//fallback to origin
+		req, err := http.NewRequest(http.MethodGet, bu.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("X-DCDN", "client")
+		req.Header.Set("X-DCDN-NOREDIRECT", "true") //caches were already tried
+		resp, err = hcl.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("blob request failed with status %q", resp.Status)
+		}
+	}
+	vr, err := h.NewVerifyingReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return vr, nil
+}
+
+//ErrBadRange is an error returned when a requested range is outside of an object
+var ErrBadRange = errors.New("Range out of bounds")
+
+//GetRange loads n bytes at offset off of an object with a hash of h
+//h must use a merkle hash type: the block list is checked against h and every block covering the range is verified
+func (c *Client) GetRange(u *url.URL, h Hash, off uint64, n uint64) (io.ReadCloser, error) {
+	if c.closed {
+		return nil, errors.New("Client closed")
+	}
+	if off > h.Len || n > h.Len-off {
+		return nil, ErrBadRange
+	}
+	if n == 0 {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	bl, err := c.GetBlocks(u, h)
+	if err != nil {
+		return nil, err
+	}
+	//extend the range to whole blocks so that they can be verified
+	bs := uint64(bl.BlockSize)
+	first := off / bs
+	start := first * bs
+	end := ((off+n-1)/bs + 1) * bs
+	if end > h.Len {
+		end = h.Len
+	}
+	rng := fmt.Sprintf("bytes=%d-%d", start, end-1)
+	srvs, hcl := c.getServers()
+	resp := c.tryCaches(srvs, 0, hcl, url.Values{
+		"hash": {h.String()},
+		"url":  {u.String()},
+	}, rng)
+	if resp == nil {
+		//fallback to origin
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("X-DCDN", "client")
+		req.Header.Set("Range", rng)
+		req.Header.Set("X-DCDN-NOREDIRECT", "true") //caches were already tried
+		resp, err = hcl.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/", start, end-1)) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("unexpected content range %q", resp.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		//server ignored the range - skip to the start
+		_, err = io.CopyN(ioutil.Discard, resp.Body, int64(start))
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("range request failed with status %q", resp.Status)
+	}
+	return &rangeReader{
+		body:   resp.Body,
+		bl:     bl,
+		total:  h.Len,
+		i:      int(first),
+		skip:   off - start,
+		remain: n,
+	}, nil
+}
+
+//getChunk loads a chunk from a cache or the origin and verifies it
+func (c *Client) getChunk(u *url.URL, ch Hash) ([]byte, error) {
+	srvs, hcl := c.getServers()
+	chstr := ch.String()
+	resp := c.tryCaches(srvs, 0, hcl, url.Values{
+		"hash":  {chstr},
+		"url":   {u.String()},
+		"chunk": {"true"},
+	}, "")
+	if resp == nil {
+		//fallback to origin
+		req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("X-DCDN", "client")
+		req.Header.Add("X-DCDN-CHUNK", chstr)
+		resp, err = hcl.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("chunk request failed with status %q", resp.Status)
+		}
+	}
+	defer resp.Body.Close()
+	vr, err := ch.NewVerifyingReader(io.LimitReader(resp.Body, int64(ch.Len)+1))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(vr)
+}
+
+//chunkReader assembles an object from its chunks
+type chunkReader struct {
+	c     *Client
+	u     *url.URL
+	cl    *ChunkList
+	store ChunkStore
+	i     int    //index of next chunk
+	buf   []byte //remaining data of the current chunk
+}
+
+func (cr *chunkReader) Read(dat []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.i == len(cr.cl.Chunks) {
+			return 0, io.EOF
+		}
+		ch := cr.cl.Chunks[cr.i].Hash
+		cd, err := cr.store.GetChunk(ch)
+		if err == ErrChunkMissing {
+			cd, err = cr.c.getChunk(cr.u, ch)
+			if err != nil {
+				return 0, err
+			}
+			err = cr.store.PutChunk(ch, cd)
+		}
+		if err != nil {
+			return 0, err
+		}
+		cr.buf = cd
+		cr.i++
+	}
+	n := copy(dat, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
+
+//rangeReader verifies the blocks of a range response and extracts the requested bytes
+type rangeReader struct {
+	body   io.ReadCloser
+	bl     *BlockList
+	total  uint64 //length of the whole object
+	i      int    //index of next block
+	skip   uint64 //bytes to drop from the start of the next block
+	remain uint64 //bytes of the range not yet loaded
+	buf    []byte //remaining data of the current block
+}
+
+func (rr *rangeReader) Read(dat []byte) (int, error) {
+	for len(rr.buf) == 0 {
+		if rr.remain == 0 {
+			return 0, io.EOF
+		}
+		bd := make([]byte, rr.bl.BlockLen(rr.i, rr.total))
+		_, err := io.ReadFull(rr.body, bd)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		err = rr.bl.VerifyBlock(rr.i, rr.total, bd)
+		if err != nil {
+			return 0, err
+		}
+		rr.i++
+		bd = bd[rr.skip:]
+		rr.skip = 0
+		if uint64(len(bd)) > rr.remain {
+			bd = bd[:rr.remain]
+		}
+		rr.remain -= uint64(len(bd))
+		rr.buf = bd
+	}
+	n := copy(dat, rr.buf)
+	rr.buf = rr.buf[n:]
+	return n, nil
+}
+
+func (rr *rangeReader) Close() error {
+	return rr.body.Close()
+}
+
 //NewClient creates a new Client (using http.DefaultClient as the http client)
 func NewClient() *Client {
 	cli := new(Client)
@@ -0,0 +1,132 @@
+package dcdn
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+//etagMatch compares two entity tags (weak comparison ignores the W/ prefix, strong comparison fails for weak tags)
+func etagMatch(a, b string, weak bool) bool {
+	if weak {
+		return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+	}
+	return a == b && !strings.HasPrefix(a, "W/")
+}
+
+//scanETag reads the first entity tag of a list
+//returns the tag and the rest of the list, or an empty tag if the list is malformed
+func scanETag(s string) (string, string) {
+	s = strings.TrimLeft(s, " \t")
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		case c == 0x21 || (c >= 0x23 && c <= 0x7E) || c >= 0x80:
+			//etagc
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+//etagListMatch checks whether an If-Match or If-None-Match header matches any of the etags
+func etagListMatch(hdr string, etags []string, weak bool) bool {
+	if strings.TrimSpace(hdr) == "*" {
+		return true
+	}
+	for {
+		hdr = strings.TrimLeft(hdr, " \t")
+		if hdr == "" {
+			return false
+		}
+		if hdr[0] == ',' {
+			hdr = hdr[1:]
+			continue
+		}
+		var tag string
+		tag, hdr = scanETag(hdr)
+		if tag == "" {
+			return false
+		}
+		for _, e := range etags {
+			if etagMatch(tag, e, weak) {
+				return true
+			}
+		}
+	}
+}
+
+//modifiedAfter checks whether modtime is later than the date in a header
+//ok is false if modtime is unknown or the date is invalid (the header is then ignored)
+func modifiedAfter(hdr string, modtime time.Time) (after bool, ok bool) {
+	if hdr == "" || modtime.IsZero() || modtime.Equal(time.Unix(0, 0)) {
+		return false, false
+	}
+	t, err := http.ParseTime(hdr)
+	if err != nil {
+		return false, false
+	}
+	//dates only have a resolution of a second
+	return modtime.Truncate(time.Second).After(t), true
+}
+
+//checkPreconditions evaluates the preconditions of a GET or HEAD request as described in RFC 7232 section 6
+//etags are the entity tags of the representation (any of them may be matched), and modtime is its modification time (zero if unknown)
+//returns true if a 304 or 412 response was sent
+func checkPreconditions(w http.ResponseWriter, r *http.Request, etags []string, modtime time.Time) bool {
+	//step 1 & 2: the client's copy must still be current
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatch(im, etags, false) {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return true
+		}
+	} else if after, ok := modifiedAfter(r.Header.Get("If-Unmodified-Since"), modtime); ok && after {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+	//step 3 & 4: the client's copy may be used
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatch(inm, etags, true) {
+			writeNotModified(w)
+			return true
+		}
+	} else if after, ok := modifiedAfter(r.Header.Get("If-Modified-Since"), modtime); ok && !after {
+		writeNotModified(w)
+		return true
+	}
+	return false
+}
+
+//writeNotModified sends a 304 response (keeping the validator and caching headers)
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Encoding")
+	if h.Get("Etag") != "" {
+		h.Del("Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+//withoutPreconditions returns a copy of a request with the preconditions removed (If-Range is kept)
+//this is used once the preconditions have been evaluated, so that http.ServeContent does not evaluate them again against a single etag
+func withoutPreconditions(r *http.Request) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.Header = r.Header.Clone()
+	for _, k := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		r2.Header.Del(k)
+	}
+	return r2
+}
@@ -0,0 +1,180 @@
+package dcdn
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+//noSeekFS is an fs.FS whose files do not support seeking
+type noSeekFS struct {
+	fs.FS
+}
+
+func (n noSeekFS) Open(name string) (fs.File, error) {
+	f, err := n.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return struct{ fs.File }{f}, nil
+}
+
+func TestConditionalRequests(t *testing.T) {
+	mt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ftime := mt.Add(500 * time.Millisecond) //dates in headers are truncated to seconds
+	dat := []byte("conditional content")
+	dir, err := ioutil.TempDir("", "dcdncond")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file"), dat, 0600)
+	os.Chtimes(filepath.Join(dir, "file"), ftime, ftime)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	hc2, err := NewHashCacheFS(noSeekFS{fstest.MapFS{
+		"file": &fstest.MapFile{Data: dat, ModTime: ftime},
+	}}, HashCacheOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc2.Close()
+	for _, v := range []*HashCache{hc, hc2} {
+		v.SetHashTypes("sha256", "sha512")
+	}
+	f, hashes, _, err := hc.GetAll("/file")
+	if err != nil {
+		t.Fatalf("Failed to get hashes: %q\n", err.Error())
+	}
+	f.Close()
+	etag := `"` + hashes[0].String() + `"`
+	etag2 := `"` + hashes[1].String() + `"`
+	date := func(t time.Time) string {
+		return t.Format(http.TimeFormat)
+	}
+	tbl := []struct {
+		name   string
+		method string
+		hdr    map[string]string
+		status int
+		seek   bool //only applies to seekable files
+	}{
+		{"none", "GET", nil, 200, false},
+		{"inm match", "GET", map[string]string{"If-None-Match": etag}, 304, false},
+		{"inm weak", "GET", map[string]string{"If-None-Match": "W/" + etag}, 304, false},
+		{"inm list", "GET", map[string]string{"If-None-Match": `"a", W/"b,c" ,` + etag}, 304, false},
+		{"inm secondary", "GET", map[string]string{"If-None-Match": etag2}, 304, false},
+		{"inm star", "GET", map[string]string{"If-None-Match": "*"}, 304, false},
+		{"inm other", "GET", map[string]string{"If-None-Match": `"other"`}, 200, false},
+		{"inm unquoted", "GET", map[string]string{"If-None-Match": hashes[0].String()}, 200, false},
+		{"inm head", "HEAD", map[string]string{"If-None-Match": etag}, 304, false},
+		{"im match", "GET", map[string]string{"If-Match": etag}, 200, false},
+		{"im list", "GET", map[string]string{"If-Match": `"other", ` + etag2}, 200, false},
+		{"im star", "GET", map[string]string{"If-Match": "*"}, 200, false},
+		{"im weak", "GET", map[string]string{"If-Match": "W/" + etag}, 412, false},
+		{"im other", "GET", map[string]string{"If-Match": `"other"`}, 412, false},
+		{"ims equal", "GET", map[string]string{"If-Modified-Since": date(mt)}, 304, false},
+		{"ims later", "GET", map[string]string{"If-Modified-Since": date(mt.Add(time.Hour))}, 304, false},
+		{"ims earlier", "GET", map[string]string{"If-Modified-Since": date(mt.Add(-time.Second))}, 200, false},
+		{"ims rfc850", "GET", map[string]string{"If-Modified-Since": mt.Format(time.RFC850)}, 304, false},
+		{"ims asctime", "GET", map[string]string{"If-Modified-Since": mt.Format(time.ANSIC)}, 304, false},
+		{"ims invalid", "GET", map[string]string{"If-Modified-Since": "yesterday"}, 200, false},
+		{"inm overrides ims", "GET", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": date(mt)}, 200, false},
+		{"ius equal", "GET", map[string]string{"If-Unmodified-Since": date(mt)}, 200, false},
+		{"ius earlier", "GET", map[string]string{"If-Unmodified-Since": date(mt.Add(-time.Second))}, 412, false},
+		{"ius invalid", "GET", map[string]string{"If-Unmodified-Since": "yesterday"}, 200, false},
+		{"im overrides ius", "GET", map[string]string{"If-Match": etag, "If-Unmodified-Since": date(mt.Add(-time.Second))}, 200, false},
+		{"412 before 304", "GET", map[string]string{"If-Match": `"other"`, "If-None-Match": etag}, 412, false},
+		{"ius and inm", "GET", map[string]string{"If-Unmodified-Since": date(mt), "If-None-Match": etag}, 304, false},
+		{"range", "GET", map[string]string{"Range": "bytes=0-3"}, 206, true},
+		{"if-range match", "GET", map[string]string{"Range": "bytes=0-3", "If-Range": etag}, 206, true},
+		{"if-range other", "GET", map[string]string{"Range": "bytes=0-3", "If-Range": `"other"`}, 200, true},
+		{"if-range date", "GET", map[string]string{"Range": "bytes=0-3", "If-Range": date(mt)}, 206, true},
+		{"if-range old date", "GET", map[string]string{"Range": "bytes=0-3", "If-Range": date(mt.Add(-time.Second))}, 200, true},
+	}
+	for i, c := range []*HashCache{hc, hc2} {
+		srv := httptest.NewServer(FileServer{HashCache: c, ErrLogger: func(error) {}})
+		for _, v := range tbl {
+			if v.seek && i == 1 {
+				continue
+			}
+			req, _ := http.NewRequest(v.method, srv.URL+"/file", nil)
+			for k, hv := range v.hdr {
+				req.Header.Set(k, hv)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				srv.Close()
+				t.Fatalf("[%s] Request failed: %q\n", v.name, err.Error())
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != v.status {
+				t.Errorf("[%s] (server %d) Expected status %d but got %d\n", v.name, i, v.status, resp.StatusCode)
+				continue
+			}
+			switch v.status {
+			case 200:
+				if v.method == "GET" && string(body) != string(dat) {
+					t.Errorf("[%s] (server %d) Bad body %q\n", v.name, i, body)
+				}
+			case 304:
+				if len(body) != 0 || resp.Header.Get("Etag") != etag || resp.Header.Get("X-DCDN-HASH") == "" {
+					t.Errorf("[%s] (server %d) Bad 304 response: %q %v\n", v.name, i, body, resp.Header)
+				}
+			}
+		}
+		srv.Close()
+	}
+	//the client returns precondition responses from the origin instead of fetching the content from a cache
+	srv := httptest.NewServer(FileServer{HashCache: hc, ErrLogger: func(error) {}})
+	defer srv.Close()
+	hits := 0
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("X-DCDN", "cache")
+		w.Write(dat)
+	}))
+	defer cache.Close()
+	cu, _ := url.Parse(cache.URL)
+	cli := NewClient()
+	defer cli.Close()
+	cli.SetSelector(StaticSelector{cu})
+	for _, v := range []struct {
+		hdr    string
+		val    string
+		status int
+	}{
+		{"If-Match", `"nope"`, 412},
+		{"If-None-Match", "*", 304},
+		{"If-None-Match", `"nope"`, 200},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/file", nil)
+		req.Header.Set(v.hdr, v.val)
+		resp, _, err := cli.GetReq(req)
+		if err != nil {
+			t.Fatalf("[%s: %s] Client request failed: %q\n", v.hdr, v.val, err.Error())
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != v.status {
+			t.Errorf("[%s: %s] Expected status %d but got %d\n", v.hdr, v.val, v.status, resp.StatusCode)
+		}
+		if v.status != 200 && len(body) != 0 {
+			t.Errorf("[%s: %s] Unexpected body %q\n", v.hdr, v.val, body)
+		}
+	}
+	if hits != 1 {
+		t.Fatalf("Expected 1 cache request but got %d\n", hits)
+	}
+}
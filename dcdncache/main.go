@@ -1,7 +1,10 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,6 +13,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -33,6 +37,16 @@ type cachereq struct {
 	err error
 }
 
+type cachealias struct {
+	c     *cachent
+	names []string
+}
+
+type cachedrop struct {
+	c    *cachent
+	hstr string
+}
+
 type fiterator struct {
 	n   uint64
 	dir string
@@ -46,9 +60,40 @@ func (f *fiterator) next() (*os.File, error) {
 func main() {
 	var dir string
 	var h string
+	var keys string
+	var minstrength int
+	var mirrorlist string
 	flag.StringVar(&dir, "dir", "cache", "dir to use for caching")
 	flag.StringVar(&h, "http", ":8080", "http to bind to")
+	flag.IntVar(&minstrength, "minstrength", 0, "minimum hash strength to accept")
+	flag.StringVar(&keys, "originkeys", "", "comma-separated base64 ed25519 public keys which origin hashes must be signed with")
+	flag.StringVar(&mirrorlist, "mirrors", "", "comma-separated DCDN origin URLs to fetch objects from by hash if the requested origin fails")
 	flag.Parse()
+	dcdn.SetHashPolicy(dcdn.HashPolicy{
+		MinStrength:     minstrength,
+		AllowDeprecated: true,
+	})
+	if keys != "" {
+		var pks []ed25519.PublicKey
+		for _, k := range strings.Split(keys, ",") {
+			pk, err := base64.StdEncoding.DecodeString(k)
+			if err != nil || len(pk) != ed25519.PublicKeySize {
+				log.Fatalf("Invalid origin key %q\n", k)
+			}
+			pks = append(pks, ed25519.PublicKey(pk))
+		}
+		cli.SetOriginKeys(pks...)
+	}
+	var mirrors []*url.URL
+	if mirrorlist != "" {
+		for _, m := range strings.Split(mirrorlist, ",") {
+			mu, err := url.Parse(m)
+			if err != nil {
+				log.Fatalf("Invalid mirror URL %q\n", m)
+			}
+			mirrors = append(mirrors, mu)
+		}
+	}
 	delch := make(chan string, 20) //channel for files to be deleted
 	for i := 0; i < 4; i++ {
 		go func() { //worker that deletes files
@@ -61,7 +106,8 @@ func main() {
 		}()
 	}
 	wch := make(chan *cachereq, 2)
-	failch := make(chan *dcdn.Hash, 1)
+	failch := make(chan cachedrop, 1)
+	aliasch := make(chan cachealias, 2)
 	go func() { //cache manager
 		ctbl := make(map[string]*cachent) //cache entry table
 		var fit fiterator
@@ -74,6 +120,10 @@ func main() {
 					if func() bool {
 						v.Lock()
 						defer v.Unlock()
+						if v.fpath == "" { //already deleted under another hash
+							delete(ctbl, i)
+							return false
+						}
 						if time.Since(v.lastused) > (5 * time.Minute) {
 							select {
 							case delch <- v.fpath: //delete it if possible
@@ -93,6 +143,14 @@ func main() {
 				h := req.h
 				hstr := h.String()
 				ce := ctbl[hstr]
+				if ce != nil && ce.TryLock() { //not in use - check that the file still exists
+					if ce.fpath == "" { //deleted (an alias of a pruned entry, or a failed download) - fetch it again
+						ce.Unlock()
+						ce = nil
+					} else {
+						ce.Unlock()
+					}
+				}
 				if ce == nil {
 					ce = new(cachent)
 					ctbl[hstr] = ce
@@ -106,12 +164,25 @@ func main() {
 				}
 				req.c = ce
 				req.Unlock()
-			case h := <-failch: //download failure notification
-				delete(ctbl, h.String())
+			case d := <-failch: //download failure notification
+				if ctbl[d.hstr] == d.c { //unless it was already replaced
+					delete(ctbl, d.hstr)
+				}
+			case a := <-aliasch: //index a downloaded blob under all of its hashes
+				for _, n := range a.names {
+					if ctbl[n] == nil {
+						ctbl[n] = a.c
+					}
+				}
 			}
 		}
 	}()
 	http.HandleFunc("/cache", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+			return
+		}
 		//parse query
 		err := r.ParseForm()
 		if err != nil {
@@ -119,7 +190,7 @@ func main() {
 			log.Printf("Failed to parse form: %q\n", err.Error())
 			return
 		}
-		hstr, src := r.Header.Get("hash"), r.Header.Get("url")
+		hstr, src := r.Form.Get("hash"), r.Form.Get("url")
 		if hstr == "" {
 			http.Error(w, "missing hash in query", http.StatusBadRequest)
 			log.Println("missing hash in request query")
@@ -136,6 +207,7 @@ func main() {
 			log.Printf("Failed to parse hash: %q\n", err.Error())
 			return
 		}
+		enc := r.Form.Get("encoding") //content encoding of the object (the hash is of the encoded bytes)
 		srcu, err := url.Parse(src)
 		if err != nil {
 			http.Error(w, "invalid source url", http.StatusBadRequest)
@@ -143,30 +215,111 @@ func main() {
 			return
 		}
 		//send cache request
-		var req cachereq //build request
-		req.Lock()
-		req.h = h
-		wch <- &req //send request
-		req.Lock()  //wait for completion
+		var req *cachereq
+		for i := 0; ; i++ {
+			req = new(cachereq) //build request
+			req.Lock()
+			req.h = h
+			wch <- req //send request
+			req.Lock() //wait for completion
+			if req.f != nil {
+				break
+			}
+			req.c.Lock()
+			if req.c.fpath != "" {
+				break
+			}
+			//the file was deleted while we waited - try again with a new entry
+			req.c.Unlock()
+			if i == 2 {
+				http.Error(w, "cache entry unavailable", http.StatusServiceUnavailable)
+				log.Printf("Cache entry for %q was deleted repeatedly\n", hstr)
+				return
+			}
+		}
 		//load data
 		if req.f != nil { //not in cache yet - load it
-			err = func() error {
-				resp, hash, err := cli.Get(srcu)
+			load := func(src string) error {
+				_, err := req.f.Seek(0, io.SeekStart) //discard data from failed attempts
+				if err == nil {
+					err = req.f.Truncate(0)
+				}
 				if err != nil {
 					return err
 				}
-				defer resp.Body.Close()
-				veri, _ := hash.Verifier()
-				_, err = io.Copy(req.f, io.TeeReader(resp.Body, veri))
+				oreq, err := http.NewRequest(http.MethodGet, src, nil)
 				if err != nil {
 					return err
 				}
-				err = veri.Verify()
+				oreq.Header.Set("X-DCDN-NOREDIRECT", "true") //the origin must not send us to a cache
+				//request the same encoding as the client (and keep the http.Transport from decompressing it)
+				if enc != "" {
+					oreq.Header.Set("Accept-Encoding", enc)
+				} else {
+					oreq.Header.Set("Accept-Encoding", "identity")
+				}
+				if r.Form.Get("chunk") != "" {
+					//request a single content-defined chunk (stored like any other object, keyed by hash)
+					oreq.Header.Set("X-DCDN-CHUNK", hstr)
+				}
+				resp, _, err := cli.GetReq(oreq)
+				if err != nil {
+					return err
+				}
+				defer resp.Body.Close()
+				//verify against every (signed) hash the origin advertises so the blob can be indexed under all of them
+				hashes := cli.ResponseHashes(resp, oreq.URL)
+				var names []string
+				var rd io.Reader = resp.Body
+				for _, v := range hashes {
+					if v.Len != h.Len {
+						continue
+					}
+					vr, err := v.NewVerifyingReader(rd)
+					if err != nil {
+						continue //unsupported hash type
+					}
+					rd = vr
+					names = append(names, v.String())
+				}
+				found := false
+				for _, v := range names {
+					if v == hstr {
+						found = true
+					}
+				}
+				if !found {
+					return errors.New("origin hash does not match requested hash")
+				}
+				_, err = io.Copy(req.f, rd)
 				if err != nil {
 					return err
 				}
+				a := cachealias{c: req.c, names: names}
+				select { //register aliases
+				case aliasch <- a:
+					//NOTE: could cause deadlock if only done synchronously
+				default:
+					go func() { aliasch <- a }()
+				}
 				return nil
-			}()
+			}
+			srcs := []string{srcu.String()}
+			if r.Form.Get("chunk") == "" {
+				//mirrors can serve the object by hash
+				for _, m := range mirrors {
+					srcs = append(srcs, dcdn.BlobURL(m, *h).String())
+				}
+			}
+			for i, s := range srcs {
+				err = load(s)
+				if err == nil {
+					break
+				}
+				if i < len(srcs)-1 {
+					log.Printf("Failed to download data from %q, trying a mirror: %q\n", s, err.Error())
+				}
+			}
 			req.f.Close()
 			if err != nil {
 				http.Error(w, "failed to download data", http.StatusBadGateway)
@@ -180,16 +333,15 @@ func main() {
 				default:
 					go func() { delch <- fpath }()
 				}
+				d := cachedrop{c: req.c, hstr: hstr}
 				select { //notify of failure
-				case failch <- h:
+				case failch <- d:
 					//NOTE: could cause deadlock if only done synchronously
 				default:
-					go func() { failch <- h }()
+					go func() { failch <- d }()
 				}
 				return
 			}
-		} else {
-			req.c.Lock()
 		}
 		defer req.c.Unlock()
 		f, err := os.Open(req.c.fpath)
@@ -198,14 +350,19 @@ func main() {
 			log.Printf("failed to open cache file: %q\n", err.Error())
 			return
 		}
+		defer f.Close()
 		w.Header().Add("X-DCDN", "cache")
 		w.Header().Set("X-DCDN-HASH", hstr)
-		w.Header().Set("Etag", hstr)
+		w.Header().Set("Etag", `"`+hstr+`"`)
+		if enc != "" {
+			w.Header().Set("Content-Encoding", enc)
+		}
 		w.Header().Add("Cache-Control", "public")
 		w.Header().Add("Cache-Control", "only-if-cached")
 		w.Header().Add("Cache-Control", "immutable")
 		w.Header().Add("Cache-Control", "no-transform")
-		io.Copy(w, f)
+		//handles range and HEAD requests (ranges are always relative to the full object)
+		http.ServeContent(w, r, "", time.Time{}, f)
 	})
 	http.HandleFunc("/checkcdn", func(w http.ResponseWriter, r *http.Request) {
 		r.Header.Add("X-DCDN", "cache")
@@ -1,12 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"net/url"
@@ -37,21 +34,16 @@ func main() {
 					goproxy.ContentTypeText, http.StatusBadGateway,
 					"DCDN request failed")
 			}
-			v, _ := h.Verifier()
-			buf := bytes.NewBuffer(nil)
-			_, err = io.Copy(buf, io.TeeReader(resp.Body, v))
-			if err != nil {
-				return r, goproxy.NewResponse(r,
-					goproxy.ContentTypeText, http.StatusBadGateway,
-					"DCDN request failed")
-			}
-			err = v.Verify()
-			if err != nil {
-				return r, goproxy.NewResponse(r,
-					goproxy.ContentTypeText, http.StatusBadGateway,
-					"DCDN request hash mismatch")
+			if h != nil && !resp.Uncompressed { //decompressed bodies were already verified by the client
+				vr, err := h.NewVerifyingReader(resp.Body)
+				if err != nil {
+					resp.Body.Close()
+					return r, goproxy.NewResponse(r,
+						goproxy.ContentTypeText, http.StatusBadGateway,
+						"DCDN request hash unsupported")
+				}
+				resp.Body = vr
 			}
-			resp.Body = ioutil.NopCloser(buf)
 			return r, resp
 		}
 		return r, nil
@@ -2,9 +2,16 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
 	"flag"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	".."
 )
@@ -12,16 +19,166 @@ import (
 func main() {
 	var dir string
 	var h string
+	var keyfile string
+	var hashtypes string
+	var minstrength int
+	var index string
+	var watch bool
+	var warm bool
+	var cachesize int
+	var cachettl time.Duration
+	var eviction string
+	var precomputed string
+	var verifyrate float64
+	var symlinks string
+	var hidden bool
+	var asyncsize int64
+	var compressed bool
+	var caches string
+	var redirect string
+	var redirectlimit int64
 	flag.StringVar(&dir, "dir", ".", "directory to serve")
 	flag.StringVar(&h, "http", ":8080", "http address to serve on")
+	flag.StringVar(&hashtypes, "hash", "sha256", "comma-separated hash types to advertise (primary first)")
+	flag.StringVar(&index, "index", "", "file to keep a persistent hash index in (disabled if empty)")
+	flag.IntVar(&cachesize, "cachesize", 0, "maximum number of files to cache hashes of (0 for no limit)")
+	flag.DurationVar(&cachettl, "cachettl", 10*time.Minute, "time after which unused hashes are dropped from memory (negative to disable)")
+	flag.StringVar(&eviction, "eviction", "lru", "eviction policy used when the cache is full (lru or lfu)")
+	flag.StringVar(&precomputed, "precomputed", "", "comma-separated sources of precomputed hashes to trust (sidecar, manifest, xattr)")
+	flag.Float64Var(&verifyrate, "verifyrate", 0, "fraction of precomputed hashes to check against the content")
+	flag.StringVar(&symlinks, "symlinks", "within-root", "symlink policy (within-root, follow or deny)")
+	flag.BoolVar(&hidden, "hidden", false, "serve hidden files (names starting with a dot)")
+	flag.Int64Var(&asyncsize, "asyncsize", 0, "serve files of at least this many bytes without hashes until they are hashed in the background (0 to disable)")
+	flag.BoolVar(&compressed, "compressed", false, "serve precompressed .br and .gz siblings of files to clients which accept them")
+	flag.BoolVar(&warm, "warm", false, "precompute hashes of all files on startup (use with -index or a negative -cachettl to keep them)")
+	flag.BoolVar(&watch, "watch", false, "watch the directory and rehash changed files in the background")
+	flag.IntVar(&minstrength, "minstrength", 0, "minimum hash strength to advertise")
+	flag.StringVar(&caches, "caches", "", "comma-separated cache URLs to redirect clients to")
+	flag.StringVar(&redirect, "redirect", "", "when to redirect clients to the caches (always, size or concurrency; disabled if empty)")
+	flag.Int64Var(&redirectlimit, "redirectlimit", 0, "file size or number of concurrent transfers above which clients are redirected")
+	flag.StringVar(&keyfile, "signkey", "", "file containing a base64 ed25519 seed used to sign hashes")
 	flag.Parse()
-	hc, err := dcdn.NewHashCache(dir)
+	dcdn.SetHashPolicy(dcdn.HashPolicy{
+		MinStrength:     minstrength,
+		AllowDeprecated: true,
+	})
+	opts := dcdn.HashCacheOptions{
+		MaxEntries: cachesize,
+		TTL:        cachettl,
+		Index:      index,
+		VerifyRate: verifyrate,
+		Paths:      dcdn.PathPolicy{AllowHidden: hidden},
+	}
+	switch symlinks {
+	case "within-root":
+		opts.Paths.Symlinks = dcdn.SymlinkWithinRoot
+	case "follow":
+		opts.Paths.Symlinks = dcdn.SymlinkFollow
+	case "deny":
+		opts.Paths.Symlinks = dcdn.SymlinkDeny
+	default:
+		log.Fatalf("Unknown symlink policy %q\n", symlinks)
+	}
+	if precomputed != "" {
+		for _, src := range strings.Split(precomputed, ",") {
+			switch src {
+			case "sidecar":
+				opts.Precomputed |= dcdn.PrecomputedSidecar
+			case "manifest":
+				opts.Precomputed |= dcdn.PrecomputedManifest
+			case "xattr":
+				opts.Precomputed |= dcdn.PrecomputedXattr
+			default:
+				log.Fatalf("Unknown precomputed hash source %q\n", src)
+			}
+		}
+	}
+	switch eviction {
+	case "lru":
+		opts.Eviction = dcdn.EvictLRU
+	case "lfu":
+		opts.Eviction = dcdn.EvictLFU
+	default:
+		log.Fatalf("Unknown eviction policy %q\n", eviction)
+	}
+	hc, err := dcdn.NewHashCacheWithOptions(dir, opts)
 	if err != nil {
 		log.Fatalf("Failed to create hash cache: %q\n", err.Error())
 	}
+	if watch {
+		err = hc.Watch()
+		if err != nil {
+			log.Fatalf("Failed to watch directory: %q\n", err.Error())
+		}
+	}
+	err = hc.SetHashTypes(strings.Split(hashtypes, ",")...)
+	if err != nil {
+		log.Fatalf("Failed to set hash types: %q\n", err.Error())
+	}
+	fs := dcdn.FileServer{HashCache: hc, AsyncHashSize: asyncsize, Precompressed: compressed}
+	switch redirect {
+	case "":
+	case "always":
+		fs.Redirect = dcdn.RedirectAlways{}
+	case "size":
+		fs.Redirect = dcdn.RedirectSize(redirectlimit)
+	case "concurrency":
+		fs.Redirect = &dcdn.RedirectConcurrency{Max: redirectlimit}
+	default:
+		log.Fatalf("Unknown redirect policy %q\n", redirect)
+	}
+	if caches != "" {
+		var sel dcdn.StaticSelector
+		for _, c := range strings.Split(caches, ",") {
+			u, err := url.Parse(c)
+			if err != nil {
+				log.Fatalf("Failed to parse cache URL: %q\n", err.Error())
+			}
+			sel = append(sel, u)
+		}
+		fs.Caches = sel
+	}
+	if keyfile != "" {
+		dat, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			log.Fatalf("Failed to load signing key: %q\n", err.Error())
+		}
+		seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(dat)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			log.Fatalln("Invalid signing key")
+		}
+		fs.SigningKey = ed25519.NewKeyFromSeed(seed)
+		log.Printf("Signing hashes with public key %q\n", base64.StdEncoding.EncodeToString(fs.SigningKey.Public().(ed25519.PublicKey)))
+	}
+	if warm {
+		if index == "" && cachettl >= 0 {
+			log.Println("Warning: warmed hashes expire after -cachettl without -index")
+		}
+		go func() {
+			log.Println("Starting warm-up scan")
+			start := time.Now()
+			last := start
+			res, err := hc.WarmWith(context.Background(), dcdn.WarmOptions{
+				Progress: func(p dcdn.WarmProgress) {
+					if p.Err != nil {
+						log.Printf("Failed to warm %q: %q\n", p.Path, p.Err.Error())
+					}
+					if time.Since(last) > 5*time.Second {
+						last = time.Now()
+						log.Printf("Warm-up: %d/%d files, %d bytes hashed\n", p.Done, p.Found, p.Bytes)
+					}
+				},
+			})
+			if err != nil {
+				log.Printf("Warm-up scan failed: %q\n", err.Error())
+				return
+			}
+			log.Printf("Warm-up complete: %d files (%d bytes) hashed in %s, %d errors\n", res.Files, res.Bytes, time.Since(start), len(res.Errors))
+		}()
+	}
 	errch := make(chan error)
 	go func() {
-		errch <- http.ListenAndServe(h, dcdn.FileServer{HashCache: hc})
+		errch <- http.ListenAndServe(h, fs)
 	}()
 	log.Printf("Serving on %q\n", h)
 	log.Fatalf("http.ListenAndServe crashed: %q\n", (<-errch).Error())
@@ -0,0 +1,188 @@
+package dcdn
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+//encoding is a content encoding which may be served from a precompressed sibling file
+type encoding struct {
+	name   string //Content-Encoding value
+	suffix string //suffix of the sibling file
+}
+
+//precompressed encodings in order of preference
+var encodings = []encoding{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+//acceptedEncodings parses an Accept-Encoding header and returns the precompressed encodings it allows (in order of preference)
+func acceptedEncodings(accept string) []encoding {
+	q := make(map[string]float64)
+	for _, v := range strings.Split(accept, ",") {
+		parts := strings.Split(v, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		weight := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				w, err := strconv.ParseFloat(p[2:], 64)
+				if err == nil {
+					weight = w
+				}
+			}
+		}
+		q[name] = weight
+	}
+	var ok []encoding
+	for _, e := range encodings {
+		w, found := q[e.name]
+		if !found {
+			w, found = q["*"]
+		}
+		if found && w > 0 {
+			ok = append(ok, e)
+		}
+	}
+	return ok
+}
+
+//serveEncoded sends a precompressed sibling of the requested file if the client accepts one
+//returns false if no usable sibling exists (the caller then serves the file itself)
+func (fs FileServer) serveEncoded(w http.ResponseWriter, r *http.Request) bool {
+	accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+	if len(accepted) == 0 {
+		return false
+	}
+	inf, err := fs.HashCache.stat(cleanPath(r.URL.Path))
+	if err != nil {
+		return false
+	}
+	for _, e := range accepted {
+		f, hashes, t, err := fs.HashCache.GetAll(r.URL.Path + e.suffix)
+		if err != nil {
+			continue
+		}
+		if t.Before(inf.ModTime()) {
+			//stale sibling
+			f.Close()
+			continue
+		}
+		defer f.Close()
+		//the type is determined by the original name, and must not be sniffed from the compressed data
+		ctype := mime.TypeByExtension(path.Ext(r.URL.Path))
+		if ctype == "" {
+			ctype = "application/octet-stream"
+		}
+		w.Header().Set("Content-Type", ctype)
+		w.Header().Set("Content-Encoding", e.name)
+		fs.serveContent(w, r, f, hashes, t, false)
+		return true
+	}
+	return false
+}
+
+//decodedBody is a decompressed response body
+type decodedBody struct {
+	*gzip.Reader
+	body io.Closer //the encoded body
+}
+
+func (db decodedBody) Close() error {
+	return db.body.Close()
+}
+
+//maximum size of an encoded body which is verified in memory (larger ones are spooled to a temporary file)
+const spoolMem = 1 << 20
+
+//spoolFile is a temporary file which is removed when it is closed
+type spoolFile struct {
+	*os.File
+}
+
+func (sf spoolFile) Close() error {
+	err := sf.File.Close()
+	os.Remove(sf.Name())
+	return err
+}
+
+//spool reads all of r and verifies it against h, so that nothing is read from the returned body before it has been verified
+//the verifier rejects input longer than h, so at most h.Len bytes are stored
+func spool(r io.Reader, h Hash) (io.ReadCloser, error) {
+	v, err := h.Verifier()
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	_, err = io.CopyN(io.MultiWriter(buf, v), r, spoolMem+1)
+	switch err {
+	case io.EOF: //fits in memory
+		err = v.Verify()
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(buf), nil
+	case nil:
+	default:
+		return nil, err
+	}
+	f, err := ioutil.TempFile("", "dcdnspool")
+	if err != nil {
+		return nil, err
+	}
+	sf := spoolFile{f}
+	_, err = buf.WriteTo(f)
+	if err == nil {
+		_, err = io.Copy(io.MultiWriter(f, v), r)
+	}
+	if err == nil {
+		err = v.Verify()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		sf.Close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+//decodeResponse transparently decompresses a gzip-encoded response
+//if h is not nil, the encoded bytes are read and verified against it before anything is decompressed
+func decodeResponse(resp *http.Response, h *Hash) error {
+	var body io.ReadCloser = resp.Body
+	if h != nil {
+		var err error
+		body, err = spool(resp.Body, *h)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		if body != resp.Body {
+			body.Close()
+		}
+		return err
+	}
+	resp.Body = decodedBody{zr, body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
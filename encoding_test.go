@@ -0,0 +1,195 @@
+package dcdn
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptedEncodings(t *testing.T) {
+	tbl := []struct {
+		accept string
+		expect string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip, deflate, br", "br,gzip"},
+		{"gzip", "gzip"},
+		{"GZIP;q=0.5", "gzip"},
+		{"br;q=0, gzip", "gzip"},
+		{"*", "br,gzip"},
+		{"gzip;q=0, *;q=0.1", "br"},
+	}
+	for _, v := range tbl {
+		var names []string
+		for _, e := range acceptedEncodings(v.accept) {
+			names = append(names, e.name)
+		}
+		if got := strings.Join(names, ","); got != v.expect {
+			t.Errorf("acceptedEncodings(%q) = %q, expected %q\n", v.accept, got, v.expect)
+		}
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnenc")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	orig := []byte(strings.Repeat("hello precompressed world\n", 100))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(orig)
+	zw.Close()
+	br := []byte("not really brotli")
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), orig, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt.gz"), gz.Bytes(), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "a.txt.br"), br, 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	srv := httptest.NewServer(FileServer{HashCache: hc, Precompressed: true, ErrLogger: func(error) {}})
+	defer srv.Close()
+	get := func(accept string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/a.txt", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %q\n", err.Error())
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Failed to read body: %q\n", err.Error())
+		}
+		return resp, body
+	}
+	tbl := []struct {
+		accept string
+		enc    string
+		body   []byte
+	}{
+		{"gzip, br", "br", br},
+		{"gzip", "gzip", gz.Bytes()},
+		{"identity", "", orig},
+	}
+	for _, v := range tbl {
+		resp, body := get(v.accept)
+		if !bytes.Equal(body, v.body) || resp.Header.Get("Content-Encoding") != v.enc {
+			t.Fatalf("[%s] Bad response: %v\n", v.accept, resp.Header)
+		}
+		if resp.Header.Get("X-DCDN-HASH") != quickHash(t, v.body).String() {
+			t.Fatalf("[%s] Hash is not a hash of the encoded bytes: %v\n", v.accept, resp.Header)
+		}
+		if resp.Header.Get("Vary") != "Accept-Encoding" || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+			t.Fatalf("[%s] Bad headers: %v\n", v.accept, resp.Header)
+		}
+	}
+	//stale siblings are ignored
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "a.txt.br"), old, old)
+	if resp, _ := get("br, gzip"); resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Stale sibling served: %v\n", resp.Header)
+	}
+	//the client verifies the encoded bytes and decompresses them
+	su, _ := url.Parse(srv.URL + "/a.txt")
+	cli := NewClient()
+	defer cli.Close()
+	check := func() {
+		resp, h, err := cli.Get(su)
+		if err != nil {
+			t.Fatalf("Client request failed: %q\n", err.Error())
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil || !bytes.Equal(body, orig) {
+			t.Fatalf("Bad decompressed body: %v\n", err)
+		}
+		if !resp.Uncompressed || h == nil || h.String() != quickHash(t, gz.Bytes()).String() {
+			t.Fatalf("Bad client response: %v %v\n", resp.Header, h)
+		}
+	}
+	check()
+	//encoded objects are requested from caches by the hash of the encoded bytes
+	var query url.Values
+	var accept string
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, accept = r.URL.Query(), r.Header.Get("Accept-Encoding")
+		w.Header().Set("X-DCDN", "cache")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(gz.Bytes())
+	}))
+	defer cache.Close()
+	cu, _ := url.Parse(cache.URL)
+	cli.SetSelector(StaticSelector{cu})
+	check()
+	if query.Get("hash") != quickHash(t, gz.Bytes()).String() || query.Get("encoding") != "gzip" || accept != "gzip" {
+		t.Fatalf("Bad cache request: %v %q\n", query, accept)
+	}
+	//corrupted encoded bytes are rejected
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-DCDN", "server")
+		w.Header().Set("X-DCDN-HASH", quickHash(t, gz.Bytes()).String())
+		w.Header().Set("Content-Encoding", "gzip")
+		dat := append([]byte(nil), gz.Bytes()...)
+		dat[len(dat)/2] ^= 1
+		w.Write(dat)
+	}))
+	defer bad.Close()
+	bu, _ := url.Parse(bad.URL)
+	cli2 := NewClient()
+	defer cli2.Close()
+	resp, _, err := cli2.Get(bu)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if err != ErrMismatch {
+		t.Fatalf("Expected hash mismatch before decompression but got %v\n", err)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	for _, size := range []int{100, spoolMem + 100} {
+		dat := make([]byte, size)
+		for i := range dat {
+			dat[i] = byte(i * 7)
+		}
+		h := quickHash(t, dat)
+		r, err := spool(bytes.NewReader(dat), h)
+		if err != nil {
+			t.Fatalf("[%d] Failed to spool: %q\n", size, err.Error())
+		}
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil || !bytes.Equal(got, dat) {
+			t.Fatalf("[%d] Bad spooled data: %v\n", size, err)
+		}
+		if sf, ok := r.(spoolFile); ok {
+			if _, err := os.Stat(sf.Name()); !os.IsNotExist(err) {
+				t.Fatalf("[%d] Spool file not removed: %v\n", size, err)
+			}
+		} else if size > spoolMem {
+			t.Fatalf("[%d] Large body not spooled to a file\n", size)
+		}
+		//corrupted and extended bodies are rejected
+		dat[size/2] ^= 1
+		if _, err = spool(bytes.NewReader(dat), h); err != ErrMismatch {
+			t.Fatalf("[%d] Expected hash mismatch but got %v\n", size, err)
+		}
+		dat[size/2] ^= 1
+		if _, err = spool(bytes.NewReader(append(dat, 0)), h); err != ErrTooLong {
+			t.Fatalf("[%d] Expected too long error but got %v\n", size, err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package dcdn
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+//EvictionPolicy selects which entry a HashCache evicts when it is full
+type EvictionPolicy int
+
+//eviction policies
+const (
+	EvictLRU EvictionPolicy = iota //evict the least recently used entry
+	EvictLFU                       //evict the least frequently used entry (ties go to the least recently used)
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EvictLRU:
+		return "lru"
+	case EvictLFU:
+		return "lfu"
+	default:
+		return "unknown"
+	}
+}
+
+//evictor tracks the entries of a shard in eviction order (protected by the shard lock)
+type evictor interface {
+	add(*hcEnt)     //start tracking a new entry
+	touch(*hcEnt)   //record a use of an entry
+	remove(*hcEnt)  //stop tracking an entry
+	victim() *hcEnt //entry which should be evicted next (nil if empty)
+}
+
+func newEvictor(p EvictionPolicy) evictor {
+	if p == EvictLFU {
+		return new(lfuEvictor)
+	}
+	return &lruEvictor{l: list.New()}
+}
+
+//lruEvictor keeps entries in a list ordered by last use (most recent first)
+type lruEvictor struct {
+	l *list.List
+}
+
+func (ev *lruEvictor) add(e *hcEnt) {
+	e.elem = ev.l.PushFront(e)
+}
+
+func (ev *lruEvictor) touch(e *hcEnt) {
+	ev.l.MoveToFront(e.elem)
+}
+
+func (ev *lruEvictor) remove(e *hcEnt) {
+	ev.l.Remove(e.elem)
+	e.elem = nil
+}
+
+func (ev *lruEvictor) victim() *hcEnt {
+	b := ev.l.Back()
+	if b == nil {
+		return nil
+	}
+	return b.Value.(*hcEnt)
+}
+
+//lfuEvictor keeps entries in a heap ordered by use count
+type lfuEvictor struct {
+	ents []*hcEnt
+	seq  uint64 //use counter (for tie breaking)
+}
+
+func (ev *lfuEvictor) Len() int {
+	return len(ev.ents)
+}
+
+func (ev *lfuEvictor) Less(i, j int) bool {
+	a, b := ev.ents[i], ev.ents[j]
+	if a.uses != b.uses {
+		return a.uses < b.uses
+	}
+	return a.seq < b.seq
+}
+
+func (ev *lfuEvictor) Swap(i, j int) {
+	ev.ents[i], ev.ents[j] = ev.ents[j], ev.ents[i]
+	ev.ents[i].hidx = i
+	ev.ents[j].hidx = j
+}
+
+func (ev *lfuEvictor) Push(x interface{}) {
+	e := x.(*hcEnt)
+	e.hidx = len(ev.ents)
+	ev.ents = append(ev.ents, e)
+}
+
+func (ev *lfuEvictor) Pop() interface{} {
+	e := ev.ents[len(ev.ents)-1]
+	ev.ents[len(ev.ents)-1] = nil
+	ev.ents = ev.ents[:len(ev.ents)-1]
+	e.hidx = -1
+	return e
+}
+
+func (ev *lfuEvictor) add(e *hcEnt) {
+	ev.seq++
+	e.uses, e.seq = 1, ev.seq
+	heap.Push(ev, e)
+}
+
+func (ev *lfuEvictor) touch(e *hcEnt) {
+	ev.seq++
+	e.uses++
+	e.seq = ev.seq
+	heap.Fix(ev, e.hidx)
+}
+
+func (ev *lfuEvictor) remove(e *hcEnt) {
+	heap.Remove(ev, e.hidx)
+}
+
+func (ev *lfuEvictor) victim() *hcEnt {
+	if len(ev.ents) == 0 {
+		return nil
+	}
+	return ev.ents[0]
+}
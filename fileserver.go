@@ -1,55 +1,403 @@
 package dcdn
 
 import (
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //FileServer is a DCDN-compatible HTTP file serving handler
 type FileServer struct {
-	HashCache *HashCache  //the underlying HashCache
-	ErrLogger func(error) //function called to log errors (uses log lib if nil)
+	HashCache    *HashCache         //the underlying HashCache
+	ErrLogger    func(error)        //function called to log errors (uses log lib if nil)
+	SigningKey   ed25519.PrivateKey //key used to sign hashes (no X-DCDN-Signature header if nil)
+	SignatureTTL time.Duration      //how long hash signatures are valid (default 1 hour)
+
+	//serve precompressed siblings (name.br, name.gz) to clients which accept the encoding
+	//the advertised hashes are hashes of the encoded bytes
+	Precompressed bool
+
+	//if set, clients may be sent to one of the Caches with a 307 response instead of being sent a file
+	//requests with an X-DCDN-NOREDIRECT header are never redirected
+	Redirect RedirectPolicy
+	Caches   ServerSelector //caches to send clients to
+
+	//files of at least this many bytes are served without hashes while they are hashed in the background (0 to always wait for the hashes)
+	AsyncHashSize int64
+}
+
+//sign adds the signature header for a hash (in the same order as the X-DCDN-HASH headers)
+func (fs FileServer) sign(w http.ResponseWriter, r *http.Request, h Hash) {
+	if fs.SigningKey == nil {
+		return
+	}
+	ttl := fs.SignatureTTL
+	if ttl == 0 {
+		ttl = time.Hour
+	}
+	w.Header().Add("X-DCDN-Signature", SignHash(fs.SigningKey, h, requestURL(r), time.Now().Add(ttl)))
+}
+
+//requestURL reconstructs the URL which a request was sent to
+func requestURL(r *http.Request) *url.URL {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: r.URL.RawQuery}
 }
 
 func (fs FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		fs.serveOptions(w)
+		return
+	default:
+		w.Header().Set("Allow", allowedMethods)
 		http.Error(w, fmt.Sprintf("unsupported method %q", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
 	w.Header().Set("X-DCDN", "server")
-	f, h, t, err := fs.HashCache.Get(r.URL.Path)
-	if err != nil {
-		if fs.ErrLogger != nil {
-			fs.ErrLogger(err)
-		} else {
-			log.Printf("Failed to serve DCDN content: %q\n", err.Error())
-		}
-		if err != os.ErrNotExist {
-			http.Error(w, "Failed to load hash", http.StatusInternalServerError)
-		} else {
-			http.Error(w, "404 not found", http.StatusNotFound)
+	switch {
+	case r.Header.Get("X-DCDN-BLOCKS") != "":
+		fs.serveBlocks(w, r)
+		return
+	case r.Header.Get("X-DCDN-CHUNKS") != "":
+		fs.serveChunks(w, r)
+		return
+	case r.Header.Get("X-DCDN-CHUNK") != "":
+		fs.serveChunk(w, r)
+		return
+	case strings.HasPrefix(r.URL.Path, BlobPrefix):
+		fs.serveBlob(w, r)
+		return
+	}
+	if fs.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if fs.serveEncoded(w, r) {
+			return
 		}
+	}
+	var f io.ReadCloser
+	var hashes []*Hash
+	var t time.Time
+	var err error
+	if fs.AsyncHashSize > 0 {
+		f, hashes, t, err = fs.HashCache.GetAllAsync(r.URL.Path, fs.AsyncHashSize)
+	} else {
+		f, hashes, t, err = fs.HashCache.GetAll(r.URL.Path)
+	}
+	if err != nil {
+		fs.fail(w, err)
 		return
 	}
 	defer f.Close()
+	if hashes == nil {
+		fs.servePlain(w, r, f, t)
+		return
+	}
+	fs.serveContent(w, r, f, hashes, t, false)
+}
+
+//allowedMethods is the value of the Allow header sent by a FileServer
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+//serveOptions advertises the supported methods and DCDN features (in the X-DCDN-Features header)
+func (fs FileServer) serveOptions(w http.ResponseWriter) {
+	w.Header().Set("Allow", allowedMethods)
+	w.Header().Set("X-DCDN", "server")
+	hashtypes := fs.HashCache.HashTypes()
+	features := []string{"hashes", "chunks", "blob", "range"}
+	if hasMerkle(hashtypes) {
+		features = append(features, "blocks")
+	}
+	if fs.SigningKey != nil {
+		features = append(features, "signature")
+	}
+	if fs.Precompressed {
+		features = append(features, "encoding")
+	}
+	if fs.Redirect != nil && fs.Caches != nil {
+		features = append(features, "redirect")
+	}
+	w.Header().Set("X-DCDN-Features", strings.Join(features, ", "))
+	w.Header().Set("X-DCDN-Hash-Types", strings.Join(hashtypes, ", "))
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//servePlain sends a file without hashes (used while it is being hashed)
+func (fs FileServer) servePlain(w http.ResponseWriter, r *http.Request, f io.Reader, t time.Time) {
+	w.Header().Set("Cache-Control", "no-cache") //hashes will be available later
+	if checkPreconditions(w, r, nil, t) {
+		return
+	}
+	size := int64(-1)
+	if st, ok := f.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := st.Stat(); err == nil {
+			size = info.Size()
+		}
+	}
+	sendBody(w, r, f, size, t)
+}
+
+//sendBody sends file data (size is -1 if unknown)
+//the preconditions must already have been checked, and range requests are handled if the file supports seeking
+func sendBody(w http.ResponseWriter, r *http.Request, f io.Reader, size int64, t time.Time) {
+	if rs, ok := f.(io.ReadSeeker); ok {
+		http.ServeContent(w, withoutPreconditions(r), r.URL.Path, t, rs)
+		return
+	}
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	w.Header().Set("Last-Modified", t.Format(http.TimeFormat))
+	if r.Method != http.MethodHead {
+		io.Copy(w, f)
+	}
+}
+
+//serveContent sends a file along with its hashes
+//immutable should be set if the URL always refers to the same content
+func (fs FileServer) serveContent(w http.ResponseWriter, r *http.Request, f io.Reader, hashes []*Hash, t time.Time, immutable bool) {
+	hashes = allowedHashes(hashes)
+	if len(hashes) == 0 {
+		fs.fail(w, ErrWeakHash)
+		return
+	}
 	//caching stuff
-	hstr := h.String()
-	tstr := t.Format(http.TimeFormat)
-	w.Header().Set("X-DCDN-HASH", hstr)
-	w.Header().Set("Last-Modified", tstr)
-	w.Header().Set("Etag", hstr)
+	h := hashes[0]
+	etags := make([]string, len(hashes)) //every advertised hash identifies the content, so any of them may be used as a validator
+	for i, v := range hashes {
+		w.Header().Add("X-DCDN-HASH", v.String())
+		fs.sign(w, r, *v)
+		etags[i] = `"` + v.String() + `"`
+	}
+	w.Header().Set("Etag", `"`+h.String()+`"`)
 	w.Header().Add("Cache-Control", "public")
-	w.Header().Add("Cache-Control", "must-revalidate")
-	w.Header().Add("Cache-Control", "proxy-revalidate")
+	if immutable {
+		w.Header().Add("Cache-Control", "immutable")
+	} else {
+		w.Header().Add("Cache-Control", "must-revalidate")
+		w.Header().Add("Cache-Control", "proxy-revalidate")
+	}
 	w.Header().Add("Cache-Control", "no-transform")
-	//deal with browser cache hits
-	if r.Header.Get("If-None-Match") == hstr || r.Header.Get("If-Modified-Since") == tstr || r.Header.Get("If-Unmodified-Since") == tstr {
-		w.WriteHeader(http.StatusNotModified)
+	if checkPreconditions(w, r, etags, t) {
+		return
+	}
+	if fs.Redirect != nil && fs.Caches != nil && r.Method == http.MethodGet && r.Header.Get("X-DCDN-NOREDIRECT") == "" {
+		redirect, done := fs.Redirect.Redirect(r, *h)
+		if redirect && fs.sendToCache(w, r, h) {
+			return
+		}
+		if done != nil {
+			defer done()
+		}
+	}
+	sendBody(w, r, f, int64(h.Len), t)
+}
+
+//allowedHashes filters out hashes rejected by the hash policy
+func allowedHashes(hashes []*Hash) []*Hash {
+	var ok []*Hash
+	for _, h := range hashes {
+		if CheckHashType(h.HashType) == nil {
+			ok = append(ok, h)
+		}
+	}
+	return ok
+}
+
+//logErr logs an error
+func (fs FileServer) logErr(err error) {
+	if fs.ErrLogger != nil {
+		fs.ErrLogger(err)
+	} else {
+		log.Printf("Failed to serve DCDN content: %q\n", err.Error())
+	}
+}
+
+//fail logs an error and sends an error response
+func (fs FileServer) fail(w http.ResponseWriter, err error) {
+	fs.logErr(err)
+	switch {
+	case os.IsNotExist(err):
+		http.Error(w, "404 not found", http.StatusNotFound)
+	case err == ErrForbiddenPath:
+		http.Error(w, "403 forbidden", http.StatusForbidden)
+	case err == ErrFileChanged:
+		http.Error(w, "file changed", http.StatusServiceUnavailable)
+	case err == ErrNoBlocks:
+		http.Error(w, "hash type does not support block lists", http.StatusNotImplemented)
+	default:
+		http.Error(w, "Failed to load hash", http.StatusInternalServerError)
+	}
+}
+
+//listHash finds the hash which the block or chunk list of a file belongs to without generating the list (for HEAD requests)
+func (fs FileServer) listHash(path string, blocks bool) (*Hash, error) {
+	f, hashes, _, err := fs.HashCache.GetAll(path)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if !blocks {
+		return hashes[0], nil
+	}
+	for _, h := range hashes {
+		if _, ok := merkleParamsOf(h.HashType); ok {
+			return h, nil
+		}
+	}
+	return nil, ErrNoBlocks
+}
+
+//serveBlocks sends the block list of a file as JSON
+func (fs FileServer) serveBlocks(w http.ResponseWriter, r *http.Request) {
+	var bl *BlockList
+	var h *Hash
+	var err error
+	if r.Method == http.MethodHead {
+		h, err = fs.listHash(r.URL.Path, true)
+	} else {
+		bl, h, err = fs.HashCache.GetBlocks(r.URL.Path)
+	}
+	if err == nil {
+		err = CheckHashType(h.HashType)
+	}
+	if err != nil {
+		fs.fail(w, err)
 		return
 	}
-	//send data
-	io.Copy(w, f)
+	w.Header().Set("X-DCDN-HASH", h.String())
+	fs.sign(w, r, *h)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	err = json.NewEncoder(w).Encode(bl)
+	if err != nil {
+		fs.logErr(err)
+	}
+}
+
+//serveChunks sends the content-defined chunk list of a file as JSON
+func (fs FileServer) serveChunks(w http.ResponseWriter, r *http.Request) {
+	var cl *ChunkList
+	var h *Hash
+	var err error
+	if r.Method == http.MethodHead {
+		h, err = fs.listHash(r.URL.Path, false)
+	} else {
+		cl, h, err = fs.HashCache.GetChunks(r.URL.Path)
+	}
+	if err == nil {
+		err = CheckHashType(h.HashType)
+	}
+	if err != nil {
+		fs.fail(w, err)
+		return
+	}
+	w.Header().Set("X-DCDN-HASH", h.String())
+	fs.sign(w, r, *h)
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodHead {
+		return
+	}
+	err = json.NewEncoder(w).Encode(cl)
+	if err != nil {
+		fs.logErr(err)
+	}
+}
+
+//BlobPrefix is the URL path prefix under which a FileServer serves files by hash (followed by the hash string)
+const BlobPrefix = "/.dcdn/blob/"
+
+//serveBlob sends a file selected by its hash
+func (fs FileServer) serveBlob(w http.ResponseWriter, r *http.Request) {
+	h, err := ParseHash(strings.TrimPrefix(r.URL.Path, BlobPrefix))
+	if err != nil {
+		http.Error(w, "invalid hash", http.StatusBadRequest)
+		return
+	}
+	err = CheckHashType(h.HashType)
+	if err != nil {
+		fs.fail(w, err)
+		return
+	}
+	f, hashes, t, err := fs.HashCache.GetByHash(*h)
+	if err != nil {
+		fs.fail(w, err)
+		return
+	}
+	defer f.Close()
+	//advertise the requested hash first
+	sorted := []*Hash{h}
+	for _, v := range hashes {
+		if v.String() != h.String() {
+			sorted = append(sorted, v)
+		}
+	}
+	fs.serveContent(w, r, f, sorted, t, true)
+}
+
+//serveChunk sends a single chunk of a file (selected by the chunk hash)
+func (fs FileServer) serveChunk(w http.ResponseWriter, r *http.Request) {
+	f, h, _, err := fs.HashCache.Get(r.URL.Path)
+	if err == nil {
+		err = CheckHashType(h.HashType)
+		if err != nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		fs.fail(w, err)
+		return
+	}
+	defer f.Close()
+	cl, ch, err := fs.HashCache.GetChunks(r.URL.Path)
+	if err != nil {
+		fs.fail(w, err)
+		return
+	}
+	if ch.String() != h.String() {
+		//file changed between calls
+		http.Error(w, "file changed", http.StatusServiceUnavailable)
+		return
+	}
+	want := r.Header.Get("X-DCDN-CHUNK")
+	for _, c := range cl.Chunks {
+		if c.Hash.String() == want {
+			w.Header().Set("X-DCDN-HASH", want)
+			fs.sign(w, r, c.Hash)
+			w.Header().Set("Etag", `"`+want+`"`)
+			w.Header().Add("Cache-Control", "public")
+			w.Header().Add("Cache-Control", "immutable")
+			w.Header().Add("Cache-Control", "no-transform")
+			if checkPreconditions(w, r, []string{`"` + want + `"`}, time.Time{}) {
+				return
+			}
+			w.Header().Set("Content-Length", strconv.FormatUint(c.Hash.Len, 10))
+			if r.Method == http.MethodHead {
+				return
+			}
+			sr, err := fileSection(f, int64(c.Offset), int64(c.Hash.Len))
+			if err != nil {
+				fs.fail(w, err)
+				return
+			}
+			io.Copy(w, sr)
+			return
+		}
+	}
+	http.Error(w, "404 chunk not found", http.StatusNotFound)
 }
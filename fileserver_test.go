@@ -0,0 +1,324 @@
+package dcdn
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlobEndpoint(t *testing.T) {
+	dir := testDir(t, 2)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	hc.SetHashTypes("sha256", "sha512")
+	srv := httptest.NewServer(FileServer{HashCache: hc, ErrLogger: func(error) {}})
+	defer srv.Close()
+	su, _ := url.Parse(srv.URL)
+	cli := NewClient()
+	defer cli.Close()
+	//unknown until hashed
+	h := quickHash(t, []byte("file 0"))
+	if _, err := cli.GetBlob(su, h); err == nil {
+		t.Fatalf("Blob found before the file was hashed\n")
+	}
+	_, err = hc.Warm(context.Background())
+	if err != nil {
+		t.Fatalf("Warm failed: %q\n", err.Error())
+	}
+	rc, err := cli.GetBlob(su, h)
+	if err != nil {
+		t.Fatalf("Failed to get blob: %q\n", err.Error())
+	}
+	dat, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(dat) != "file 0" {
+		t.Fatalf("Bad blob content %q: %v\n", dat, err)
+	}
+	//secondary hash types work too, and are advertised first
+	f, hashes, _, err := hc.GetAll("/f1")
+	if err != nil {
+		t.Fatalf("Failed to get hashes: %q\n", err.Error())
+	}
+	f.Close()
+	resp, err := http.Get(BlobURL(su, *hashes[1]).String())
+	if err != nil {
+		t.Fatalf("Blob request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-DCDN-HASH") != hashes[1].String() {
+		t.Fatalf("Bad blob response: %s %v\n", resp.Status, resp.Header)
+	}
+	//old content is gone after the file changes
+	ioutil.WriteFile(filepath.Join(dir, "f0"), []byte("changed"), 0600)
+	if _, err := cli.GetBlob(su, h); err == nil {
+		t.Fatalf("Blob with old content found\n")
+	}
+	resp, err = http.Get(srv.URL + BlobPrefix + "bogus")
+	if err != nil {
+		t.Fatalf("Blob request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected bad request for invalid hash but got %s\n", resp.Status)
+	}
+}
+
+func TestFileServerAsyncHash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnasync")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	big := make([]byte, 1<<20)
+	for i := range big {
+		big[i] = byte(i*7 + i/1000)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "big"), big, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "small"), []byte("small"), 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	srv := httptest.NewServer(FileServer{HashCache: hc, AsyncHashSize: 1024})
+	defer srv.Close()
+	get := func(p string) (string, []byte) {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatalf("Request failed: %q\n", err.Error())
+		}
+		defer resp.Body.Close()
+		dat, err := ioutil.ReadAll(resp.Body)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Bad response: %s %v\n", resp.Status, err)
+		}
+		return resp.Header.Get("X-DCDN-HASH"), dat
+	}
+	//small files are hashed synchronously
+	if h, _ := get("/small"); h != quickHash(t, []byte("small")).String() {
+		t.Fatalf("Small file served without hash: %q\n", h)
+	}
+	//the first request for a large file does not wait for the hash
+	h, dat := get("/big")
+	if h != "" || !bytes.Equal(dat, big) {
+		t.Fatalf("Unexpected first response: hash %q, %d bytes\n", h, len(dat))
+	}
+	expect := quickHash(t, big).String()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		h, dat = get("/big")
+		if h != "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("File was not hashed in the background\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if h != expect || !bytes.Equal(dat, big) {
+		t.Fatalf("Bad response after hashing: %q\n", h)
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnrange")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dat := make([]byte, 300000)
+	for i := range dat {
+		dat[i] = byte(i*13 + i/777)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "big"), dat, 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	hc.SetHashType("merkle-sha256")
+	corrupt := false
+	fsrv := FileServer{HashCache: hc, ErrLogger: func(error) {}}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !corrupt || r.Header.Get("Range") == "" {
+			fsrv.ServeHTTP(w, r)
+			return
+		}
+		//flip a bit in the data
+		rec := httptest.NewRecorder()
+		fsrv.ServeHTTP(rec, r)
+		body := rec.Body.Bytes()
+		body[len(body)/2] ^= 1
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(body)
+	}))
+	defer srv.Close()
+	//plain range requests
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/big", nil)
+	req.Header.Set("Range", "bytes=100-199")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || resp.Header.Get("Content-Range") != "bytes 100-199/300000" || !bytes.Equal(body, dat[100:200]) {
+		t.Fatalf("Bad range response: %s %v\n", resp.Status, resp.Header)
+	}
+	if resp.Header.Get("X-DCDN-HASH") == "" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Fatalf("Missing headers in range response: %v\n", resp.Header)
+	}
+	req.Header.Set("Range", "bytes=0-9,-10")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") {
+		t.Fatalf("Bad multi-range response: %s %v\n", resp.Status, resp.Header)
+	}
+	req.Header.Set("Range", "bytes=400000-")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		t.Fatalf("Expected unsatisfiable range but got %s\n", resp.Status)
+	}
+	//verified ranges through the client
+	f, h, _, err := hc.Get("/big")
+	if err != nil {
+		t.Fatalf("Failed to get hash: %q\n", err.Error())
+	}
+	f.Close()
+	su, _ := url.Parse(srv.URL + "/big")
+	cli := NewClient()
+	defer cli.Close()
+	tbl := []struct {
+		off, n uint64
+	}{
+		{0, 10},
+		{65530, 20},     //crosses a block boundary
+		{100000, 65536}, //unaligned full block size
+		{299990, 10},    //end of the short last block
+		{0, 300000},
+		{5, 0},
+	}
+	for _, v := range tbl {
+		rc, err := cli.GetRange(su, *h, v.off, v.n)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d) failed: %q\n", v.off, v.n, err.Error())
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil || !bytes.Equal(got, dat[v.off:v.off+v.n]) {
+			t.Fatalf("GetRange(%d, %d) returned bad data: %v\n", v.off, v.n, err)
+		}
+	}
+	if _, err := cli.GetRange(su, *h, 299990, 11); err != ErrBadRange {
+		t.Fatalf("Expected bad range error but got %v\n", err)
+	}
+	corrupt = true
+	rc, err := cli.GetRange(su, *h, 65530, 20)
+	if err == nil {
+		_, err = ioutil.ReadAll(rc)
+		rc.Close()
+	}
+	if err == nil {
+		t.Fatalf("Corrupted range was accepted\n")
+	}
+}
+
+func TestHeadOptions(t *testing.T) {
+	dir := testDir(t, 1)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	srv := httptest.NewServer(FileServer{HashCache: hc, ErrLogger: func(error) {}})
+	defer srv.Close()
+	h := quickHash(t, []byte("file 0"))
+	//HEAD sends the headers without a body
+	req, _ := http.NewRequest(http.MethodHead, srv.URL+"/f0", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || len(body) != 0 {
+		t.Fatalf("Bad HEAD response: %s %q\n", resp.Status, body)
+	}
+	if resp.Header.Get("X-DCDN-HASH") != h.String() || resp.Header.Get("Etag") != `"`+h.String()+`"` || resp.ContentLength != int64(h.Len) {
+		t.Fatalf("Bad HEAD headers: %v\n", resp.Header)
+	}
+	su, _ := url.Parse(srv.URL + "/f0")
+	cli := NewClient()
+	defer cli.Close()
+	resp, ch, err := cli.Head(su)
+	if err != nil {
+		t.Fatalf("Client HEAD failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if ch == nil || ch.String() != h.String() {
+		t.Fatalf("Bad hash from HEAD: %v\n", ch)
+	}
+	//HEAD requests for block and chunk lists do not generate the lists
+	hc.SetHashTypes("sha256", "merkle-sha256")
+	for _, hdr := range []string{"X-DCDN-BLOCKS", "X-DCDN-CHUNKS"} {
+		req, _ := http.NewRequest(http.MethodHead, srv.URL+"/f0", nil)
+		req.Header.Set(hdr, "true")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %q\n", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("X-DCDN-HASH") == "" || resp.Header.Get("Content-Type") != "application/json" {
+			t.Fatalf("[%s] Bad HEAD response: %s %v\n", hdr, resp.Status, resp.Header)
+		}
+	}
+	if he := hc.find("/f0"); he == nil || he.blocks != nil || he.chunks != nil {
+		t.Fatalf("Lists generated for HEAD requests\n")
+	}
+	hc.SetHashTypes("sha256")
+	//OPTIONS advertises features
+	req, _ = http.NewRequest(http.MethodOptions, srv.URL+"/f0", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != "GET, HEAD, OPTIONS" {
+		t.Fatalf("Bad OPTIONS response: %s %v\n", resp.Status, resp.Header)
+	}
+	if !strings.Contains(resp.Header.Get("X-DCDN-Features"), "range") || resp.Header.Get("X-DCDN-Hash-Types") != "sha256" {
+		t.Fatalf("Bad OPTIONS headers: %v\n", resp.Header)
+	}
+	//anything else is rejected
+	resp, err = http.Post(srv.URL+"/f0", "text/plain", strings.NewReader("x"))
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") == "" {
+		t.Fatalf("Bad POST response: %s %v\n", resp.Status, resp.Header)
+	}
+}
@@ -13,14 +13,6 @@ import (
 	"strings"
 )
 
-//registry of hash function
-var hashreg = map[string](func() hash.Hash){}
-
-//RegisterHash registers a hash function
-func RegisterHash(name string, fn func() hash.Hash) {
-	hashreg[name] = fn
-}
-
 //add common hash functions
 func init() {
 	RegisterHash("sha256", func() hash.Hash {
@@ -29,13 +21,37 @@ func init() {
 	RegisterHash("sha512", func() hash.Hash {
 		return sha512.New()
 	})
+	SetHashStrength("sha256", 128)
+	SetHashStrength("sha512", 256)
+}
+
+//StrongestHash returns the strongest hash with a recognized type allowed by the hash policy (nil if there are none)
+func StrongestHash(hashes []*Hash) *Hash {
+	hashreg.lck.RLock()
+	defer hashreg.lck.RUnlock()
+	var best *Hash
+	var beststrength int
+	for _, h := range hashes {
+		if h == nil {
+			continue
+		}
+		e := hashreg.ent(h.HashType)
+		if hashreg.check(e) != nil {
+			continue
+		}
+		if best == nil || e.strength > beststrength {
+			best = h
+			beststrength = e.strength
+		}
+	}
+	return best
 }
 
 //Hash is a hash value used for DCDN
 type Hash struct {
 	HashType string
 	Hash     []byte
-	Len      uint32
+	Len      uint64
 }
 
 //ErrInvalid is an error returned when the syntax of the hash is wrong
@@ -47,22 +63,23 @@ func ParseHash(str string) (*Hash, error) {
 	if len(parts) != 3 {
 		return nil, ErrInvalid
 	}
-	if hashreg[parts[0]] == nil {
-		return nil, ErrUnrecognizedHash
+	err := CheckHashType(parts[0])
+	if err != nil {
+		return nil, err
 	}
-	htype := parts[0]
+	_, htype, _ := hashreg.lookup(parts[0]) //resolve aliases
 	hdat, err := hex.DecodeString(parts[1])
 	if err != nil {
 		return nil, err
 	}
-	l, err := strconv.ParseUint(parts[2], 10, 32)
+	l, err := strconv.ParseUint(parts[2], 10, 64)
 	if err != nil {
 		return nil, err
 	}
 	return &Hash{
 		HashType: htype,
 		Hash:     hdat,
-		Len:      uint32(l),
+		Len:      l,
 	}, nil
 }
 
@@ -81,11 +98,11 @@ func (h Hash) Verifier() (v *Verifier, err error) {
 			v = nil
 		}
 	}()
-	hf := hashreg[h.HashType]
-	if hf == nil {
-		err = ErrUnrecognizedHash
+	err = CheckHashType(h.HashType)
+	if err != nil {
 		return
 	}
+	hf := hashFunc(h.HashType)
 	v = new(Verifier)
 	v.h = hf()
 	v.hd = h.Hash
@@ -106,17 +123,17 @@ var ErrMismatch = errors.New("Hash mismatch")
 type Verifier struct {
 	hd []byte
 	h  hash.Hash
-	n  uint32
+	n  uint64
 }
 
 func (v *Verifier) Write(dat []byte) (int, error) {
-	if v.n < uint32(len(dat)) {
+	if v.n < uint64(len(dat)) {
 		v.n = 0
 		v.h = nil
 		return 0, ErrTooLong
 	}
 	n, err := v.h.Write(dat)
-	v.n -= uint32(n)
+	v.n -= uint64(n)
 	return n, err
 }
 
@@ -135,8 +152,8 @@ func (v *Verifier) Verify() error {
 }
 
 //GenHash creates a new Hash
-func GenHash(hashtype string, writehandler func(io.Writer) (uint32, error)) (*Hash, error) {
-	hf := hashreg[hashtype]
+func GenHash(hashtype string, writehandler func(io.Writer) (uint64, error)) (*Hash, error) {
+	hf := hashFunc(hashtype)
 	if hf == nil {
 		return nil, ErrUnrecognizedHash
 	}
@@ -152,3 +169,53 @@ func GenHash(hashtype string, writehandler func(io.Writer) (uint32, error)) (*Ha
 		Len:      n,
 	}, nil
 }
+
+//VerifyingReader is an io.ReadCloser which verifies data as it is read
+//at EOF, Read returns the verification error (if any) instead of io.EOF
+type VerifyingReader struct {
+	r   io.Reader
+	v   *Verifier
+	err error //sticky error
+}
+
+//NewVerifyingReader wraps r in a VerifyingReader for the hash
+func (h Hash) NewVerifyingReader(r io.Reader) (*VerifyingReader, error) {
+	v, err := h.Verifier()
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyingReader{r: r, v: v}, nil
+}
+
+func (vr *VerifyingReader) Read(dat []byte) (int, error) {
+	if vr.err != nil {
+		return 0, vr.err
+	}
+	n, err := vr.r.Read(dat)
+	if n > 0 {
+		_, werr := vr.v.Write(dat[:n])
+		if werr != nil {
+			vr.err = werr
+			return 0, werr
+		}
+	}
+	if err == io.EOF {
+		verr := vr.v.Verify()
+		if verr != nil {
+			vr.err = verr
+			return 0, verr
+		}
+	}
+	if err != nil {
+		vr.err = err
+	}
+	return n, err
+}
+
+//Close closes the underlying reader (if it is an io.Closer)
+func (vr *VerifyingReader) Close() error {
+	if c, ok := vr.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
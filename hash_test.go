@@ -1,12 +1,14 @@
 package dcdn
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"crypto/sha512"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"testing"
 )
@@ -18,7 +20,7 @@ func TestHash(t *testing.T) {
 	h := Hash{
 		HashType: "sha256",
 		Hash:     hval[:],
-		Len:      uint32(len(d)),
+		Len:      uint64(len(d)),
 	}
 	//test hash formatting
 	if h.String() != fmt.Sprintf("sha256:%x:%d", hval[:], len(d)) {
@@ -111,9 +113,9 @@ func TestHash(t *testing.T) {
 }
 
 func quickHash(t *testing.T, dat []byte) Hash {
-	h, err := GenHash("sha256", func(w io.Writer) (uint32, error) {
+	h, err := GenHash("sha256", func(w io.Writer) (uint64, error) {
 		w.Write(dat)
-		return uint32(len(dat)), nil
+		return uint64(len(dat)), nil
 	})
 	if err != nil {
 		t.Fatalf("Failed to generate sha256 hash: %q\n", err.Error())
@@ -145,14 +147,14 @@ func TestGenHash(t *testing.T) {
 		t.Fatalf("Inconsistency: %q => %q", h.String(), h2.String())
 	}
 	//test gen a bad hash type
-	ha, err := GenHash("bashash", func(w io.Writer) (uint32, error) {
+	ha, err := GenHash("bashash", func(w io.Writer) (uint64, error) {
 		t.Fatal("This should not happen\n")
 		return 0, nil
 	})
 	testErr(t, ha, err, ErrUnrecognizedHash)
 	//test write handler
 	terr := errors.New("bleh")
-	ha, err = GenHash("sha256", func(w io.Writer) (uint32, error) {
+	ha, err = GenHash("sha256", func(w io.Writer) (uint64, error) {
 		return 0, terr
 	})
 	testErr(t, ha, err, terr)
@@ -190,3 +192,91 @@ func TestParseHash(t *testing.T) {
 		Func: "ParseUint",
 	})
 }
+
+func TestHashLargeLen(t *testing.T) {
+	//lengths over 4 GiB must survive a format/parse round trip
+	hstr := fmt.Sprintf("sha256:%x:%d", make([]byte, sha256.Size), uint64(1)<<40)
+	h, err := ParseHash(hstr)
+	if err != nil {
+		t.Fatalf("Failed to parse large hash: %q\n", err.Error())
+	}
+	if h.Len != uint64(1)<<40 {
+		t.Fatalf("Wrong length: expected %d but got %d\n", uint64(1)<<40, h.Len)
+	}
+	if h.String() != hstr {
+		t.Fatalf("Hash re-parse consistency error: %q => %q\n", hstr, h.String())
+	}
+	//verifier must track the full length
+	v, err := h.Verifier()
+	if err != nil {
+		t.Fatalf("Failed to create sha256 verifier: %q\n", err.Error())
+	}
+	_, err = v.Write(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatalf("Failed to write to verifier: %q\n", err.Error())
+	}
+	err = v.Verify()
+	if err != ErrTooShort {
+		t.Fatalf("Expected too short error but got %v\n", err)
+	}
+}
+
+func TestVerifyingReader(t *testing.T) {
+	d := []byte("Some data to stream through the verifier")
+	h := quickHash(t, d)
+	//good data
+	vr, err := h.NewVerifyingReader(bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("Failed to create verifying reader: %q\n", err.Error())
+	}
+	out, err := ioutil.ReadAll(vr)
+	if err != nil {
+		t.Fatalf("Unexpected read error: %q\n", err.Error())
+	}
+	if !bytes.Equal(out, d) {
+		t.Fatalf("Data mismatch: %q != %q\n", out, d)
+	}
+	//bad data
+	tests := []struct {
+		dat []byte
+		err error
+	}{
+		{append(append([]byte(nil), d[:len(d)-1]...), 1), ErrMismatch},
+		{d[:len(d)-1], ErrTooShort},
+		{append(append([]byte(nil), d...), 1), ErrTooLong},
+	}
+	for _, v := range tests {
+		vr, err = h.NewVerifyingReader(bytes.NewReader(v.dat))
+		if err != nil {
+			t.Fatalf("Failed to create verifying reader: %q\n", err.Error())
+		}
+		_, err = ioutil.ReadAll(vr)
+		if err != v.err {
+			t.Fatalf("Expected error %v but got %v\n", v.err, err)
+		}
+		//error must be sticky
+		_, err = vr.Read(make([]byte, 1))
+		if err != v.err {
+			t.Fatalf("Expected sticky error %v but got %v\n", v.err, err)
+		}
+	}
+}
+
+func TestStrongestHash(t *testing.T) {
+	d := []byte("agility")
+	h256 := quickHash(t, d)
+	h512 := Hash{HashType: "sha512", Hash: []byte{1}, Len: h256.Len}
+	bad := Hash{HashType: "badhash", Hash: []byte{1}, Len: h256.Len}
+	if StrongestHash(nil) != nil {
+		t.Fatal("Expected nil hash from empty list\n")
+	}
+	if StrongestHash([]*Hash{&bad, nil}) != nil {
+		t.Fatal("Expected nil hash from unsupported list\n")
+	}
+	if s := StrongestHash([]*Hash{&h256, &bad, &h512}); s != &h512 {
+		t.Fatalf("Expected sha512 but got %v\n", s)
+	}
+	if s := StrongestHash([]*Hash{&bad, &h256}); s != &h256 {
+		t.Fatalf("Expected sha256 but got %v\n", s)
+	}
+}
@@ -1,181 +1,785 @@
 package dcdn
 
 import (
+	"bytes"
+	"container/list"
 	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func hashFile(f *os.File, hashtype string) (*Hash, error) {
-	return GenHash(hashtype, func(w io.Writer) (uint32, error) {
-		n, err := io.Copy(w, f)
-		if n > int64(^uint32(0)) {
-			return 0, errors.New("oversized file")
-		}
-		return uint32(n), err
-	})
+type hcEnt struct {
+	lck      sync.Mutex
+	rlck     sync.Mutex //held while refreshing in the background
+	file     string     //path to file
+	hashes   []*Hash    //hash values (one per hash type, primary first)
+	blocks   *BlockList //block hashes (for the first merkle hash type, computed on demand)
+	chunks   *ChunkList //content-defined chunks (computed on demand)
+	indexed  []*Hash    //hashes recorded in the reverse index (protected by the HashCache hlck)
+	removed  bool       //set once the entry has been removed from the cache (protected by the HashCache hlck)
+	id       fileID     //identity of the file which was hashed (set on hash update)
+	pending  int32      //set while the file is hashed in the background by GetAllAsync (atomic)
+	lastused time.Time  //last time used
+
+	refreshes int           //number of queued background refreshes (protected by lck)
+	refreshed chan struct{} //closed once the queued background refreshes are done (protected by lck)
+
+	//eviction bookkeeping (protected by the shard lock)
+	elem *list.Element //position in the LRU list
+	hidx int           //position in the LFU heap
+	uses uint64        //number of lookups
+	seq  uint64        //lookup sequence number of the last use
 }
 
-type hcEnt struct {
-	lck       sync.Mutex
-	file      string    //path to file
-	hash      *Hash     //hash value
-	timestamp time.Time //file modification time (set on hash update)
-	lastused  time.Time //last time used
+//invalidate clears the hashes so that they are recomputed on the next request
+func (e *hcEnt) invalidate(hc *HashCache) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	e.hashes, e.blocks, e.chunks = nil, nil, nil
+	hc.setHashes(e, nil)
+}
+
+//refresh rehashes the file in the background and swaps in the new hashes
+func (e *hcEnt) refresh(hc *HashCache) {
+	e.rlck.Lock()
+	defer e.rlck.Unlock()
+	e.lck.Lock()
+	chunks := e.chunks != nil
+	e.lck.Unlock()
+	tmp := &hcEnt{file: e.file}
+	_, err := tmp.update(hc, chunks)
+	if err != nil {
+		//fall back to hashing on the next request
+		e.invalidate(hc)
+	} else {
+		e.adopt(hc, tmp)
+	}
+	e.refreshDone()
+}
+
+//refreshDone marks a queued refresh as done, and wakes requests waiting for it once none are left
+func (e *hcEnt) refreshDone() {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	e.refreshes--
+	if e.refreshes == 0 {
+		close(e.refreshed)
+		e.refreshed = nil
+	}
 }
 
-func (e *hcEnt) shouldPrune() bool {
+//refreshing returns a channel which is closed once the queued background refreshes are done (nil if none are queued)
+func (e *hcEnt) refreshing() <-chan struct{} {
 	e.lck.Lock()
 	defer e.lck.Unlock()
-	return time.Since(e.lastused) > (10 * time.Minute) //evict after 10 minutes of inactivity
+	return e.refreshed
 }
 
-func (e *hcEnt) getHash(basedir string, hashtype string) (*Hash, error) {
+//adopt takes over the hashes computed with a temporary entry
+func (e *hcEnt) adopt(hc *HashCache, tmp *hcEnt) {
 	e.lck.Lock()
 	defer e.lck.Unlock()
-	fpath := filepath.Join(basedir, e.file)
-	f, err := os.Open(fpath)
+	e.hashes, e.blocks, e.chunks, e.id = tmp.hashes, tmp.blocks, tmp.chunks, tmp.id
+	hc.setHashes(e, tmp.indexed)
+}
+
+func (e *hcEnt) shouldPrune(ttl time.Duration) bool {
+	if !e.lck.TryLock() {
+		return false //in use
+	}
+	defer e.lck.Unlock()
+	return time.Since(e.lastused) > ttl
+}
+
+//getHashes gets the hashes along with the identity of the file they were computed from
+func (e *hcEnt) getHashes(hc *HashCache) ([]*Hash, fileID, error) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	hit, err := e.update(hc, false)
 	if err != nil {
-		return nil, err
+		return nil, fileID{}, err
+	}
+	hc.stats.record(hit)
+	return e.hashes, e.id, nil
+}
+
+//getBlocks gets the block list of the first merkle hash
+//block lists are only generated when they are requested, so that hashing a file does not keep a hash of every block
+func (e *hcEnt) getBlocks(hc *HashCache) (*BlockList, *Hash, error) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	for i := 0; ; i++ {
+		hit, err := e.update(hc, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		hc.stats.record(hit)
+		var h *Hash
+		for _, v := range e.hashes {
+			if _, ok := merkleParamsOf(v.HashType); ok {
+				h = v
+				break
+			}
+		}
+		if h == nil {
+			return nil, nil, ErrNoBlocks
+		}
+		if e.blocks != nil && e.blocks.HashType == h.HashType {
+			return e.blocks, h, nil
+		}
+		f, _, err := hc.open(e.file)
+		if err != nil {
+			return nil, nil, err
+		}
+		bl, bh, err := GenBlockList(h.HashType, f)
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if bh.Len == h.Len && bytes.Equal(bh.Hash, h.Hash) {
+			e.blocks = bl
+			return bl, h, nil
+		}
+		//the file changed after it was hashed
+		if i == snapshotRetries {
+			return nil, nil, ErrMismatch
+		}
+		e.hashes, e.blocks, e.chunks = nil, nil, nil
+		hc.setHashes(e, nil)
+	}
+}
+
+func (e *hcEnt) getChunks(hc *HashCache) (*ChunkList, *Hash, error) {
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	hit, err := e.update(hc, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	hc.stats.record(hit)
+	return e.chunks, e.hashes[0], nil
+}
+
+//current checks whether the entry has hashes of the given types
+func (e *hcEnt) current(hashtypes []string) bool {
+	if len(e.hashes) != len(hashtypes) {
+		return false
+	}
+	for i, h := range e.hashes {
+		if h.HashType != hashtypes[i] {
+			return false
+		}
+	}
+	return true
+}
+
+//hasMerkle checks whether any of the hash types is a merkle hash type
+func hasMerkle(hashtypes []string) bool {
+	for _, t := range hashtypes {
+		if _, ok := merkleParamsOf(t); ok {
+			return true
+		}
+	}
+	return false
+}
+
+//config returns the hash types and whether the content is watched
+//hc.lck is only held while reading them, so that changing the settings never waits for a file to be hashed
+func (hc *HashCache) config() ([]string, bool) {
+	hc.lck.RLock()
+	defer hc.lck.RUnlock()
+	return hc.hashtypes, hc.watcher != nil
+}
+
+//update rehashes the file if it is out of date (must be called with e.lck held)
+//all hash types are computed in a single pass, and if chunks is set the chunk list is also computed
+//the returned bool reports whether the cached hashes could be used as they were
+func (e *hcEnt) update(hc *HashCache, chunks bool) (bool, error) {
+	hashtypes, watching := hc.config()
+	if watching && e.refreshes == 0 && e.hashes != nil && e.current(hashtypes) && (!chunks || e.chunks != nil) {
+		//the watcher keeps known hashes up to date (unless a change has been noticed but not rehashed yet)
+		e.lastused = time.Now()
+		return true, nil
+	}
+	f, inf, err := hc.open(e.file)
+	if err != nil {
+		return false, err
 	}
 	defer f.Close()
 	defer func() {
 		e.lastused = time.Now()
 	}()
-	inf, err := f.Stat()
+	id := statID(inf)
+	if id != e.id || !e.current(hashtypes) { //out of date - invalidate
+		e.hashes, e.blocks, e.chunks = nil, nil, nil
+		hc.setHashes(e, nil)
+	}
+	if e.hashes != nil && (!chunks || e.chunks != nil) {
+		return true, nil
+	}
+	//check the persistent index (which has no chunk lists)
+	if e.hashes == nil && !chunks && hc.index != nil {
+		if hashes := hc.index.lookup(e.file, id, hashtypes); hashes != nil {
+			e.hashes = hashes
+			e.id = id
+			hc.setHashes(e, hashes)
+			return false, nil
+		}
+	}
+	//check precomputed hashes
+	var verify []*Hash
+	if e.hashes == nil && !chunks && hc.opts.Precomputed != 0 {
+		if hashes := hc.precomputed(e.file, inf, hashtypes); hashes != nil {
+			if !hc.spotCheck() {
+				e.hashes = hashes
+				e.id = id
+				hc.setHashes(e, hashes)
+				return false, nil
+			}
+			verify = hashes
+		}
+	}
+	//hash the file
+	hs := make([]hash.Hash, len(hashtypes))
+	ws := make([]io.Writer, len(hashtypes), len(hashtypes)+1)
+	for i, t := range hashtypes {
+		hf := hashFunc(t)
+		if hf == nil {
+			return false, ErrUnrecognizedHash
+		}
+		hs[i] = hf()
+		ws[i] = hs[i]
+	}
+	var cw *chunkWriter
+	if chunks {
+		cw, err = newChunkWriter(hashtypes[0])
+		if err != nil {
+			return false, err
+		}
+		ws = append(ws, cw)
+	}
+	n, err := io.Copy(io.MultiWriter(ws...), f)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	mt := inf.ModTime()
-	if mt != e.timestamp { //out of date - update hash
-		h, err := hashFile(f, hashtype)
+	e.hashes = make([]*Hash, len(hashtypes))
+	for i, t := range hashtypes {
+		e.hashes[i] = &Hash{
+			HashType: t,
+			Hash:     hs[i].Sum(nil),
+			Len:      uint64(n),
+		}
+	}
+	if chunks {
+		e.chunks = cw.list()
+	}
+	e.id = id
+	hc.setHashes(e, e.hashes)
+	for i, h := range verify {
+		if !bytes.Equal(h.Hash, e.hashes[i].Hash) {
+			hc.logErr(fmt.Errorf("precomputed %s hash of %q does not match the content: %w", h.HashType, e.file, ErrMismatch))
+			atomic.AddUint64(&hc.stats.mismatches, 1)
+			break
+		}
+	}
+	if hc.index != nil {
+		err = hc.index.store(e.file, id, e.hashes)
 		if err != nil {
-			return nil, err
+			hc.logErr(fmt.Errorf("failed to update hash index: %w", err))
 		}
-		e.hash = h
-		e.timestamp = mt
 	}
-	return e.hash, nil
+	return false, nil
 }
 
-//HashCache is a cache for hash values of files
-type HashCache struct {
-	lck      sync.RWMutex
-	wch      chan *hreq
-	hashtype string //hash type to use
-	dir      string //content directory
+//HashCacheOptions are options for a HashCache
+//the persistent Index only stores hashes, not block or chunk lists, so GetBlocks and GetChunks hash the file again after a restart
+type HashCacheOptions struct {
+	MaxEntries int            //maximum number of cached files (0 for no limit)
+	Eviction   EvictionPolicy //which entry to evict when MaxEntries is reached
+	TTL        time.Duration  //time after which unused entries expire (0 for the default of 10 minutes, negative to disable)
+	Index      string         //file to keep a persistent hash index in (compacted on startup and updated whenever a file is hashed, disabled if empty)
+	Paths      PathPolicy     //restrictions on which files may be served
+	ErrLogger  func(error)    //function called to log errors which do not fail a request, such as a failed index update (uses log lib if nil)
+
+	Precomputed PrecomputedSource //sources of precomputed hashes to trust (none if 0)
+	VerifyRate  float64           //fraction of precomputed hashes which are spot-checked against the content (0 to 1)
+}
+
+//logErr logs an error which does not fail a request
+func (hc *HashCache) logErr(err error) {
+	if hc.opts.ErrLogger != nil {
+		hc.opts.ErrLogger(err)
+	} else {
+		log.Printf("Hash cache error: %q\n", err.Error())
+	}
+}
+
+//default time after which unused entries expire
+const defaultTTL = 10 * time.Minute
+
+//HashCacheStats are statistics about a HashCache
+type HashCacheStats struct {
+	Entries     int    //number of cached files
+	Hits        uint64 //requests answered with cached hashes
+	Misses      uint64 //requests which required hashing the file (or loading the hashes from the index or a precomputed source)
+	Evictions   uint64 //entries evicted because the cache was full
+	Expirations uint64 //entries removed because they were unused for longer than the TTL
+	Mismatches  uint64 //precomputed hashes which failed a spot check
 }
 
-type hreq struct {
-	lck  sync.Mutex
-	name string
-	he   *hcEnt
-	err  error
+//cache statistics counters (updated atomically)
+type hcStats struct {
+	entries     int64
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+	mismatches  uint64
+}
+
+func (st *hcStats) record(hit bool) {
+	if hit {
+		atomic.AddUint64(&st.hits, 1)
+	} else {
+		atomic.AddUint64(&st.misses, 1)
+	}
+}
+
+//HashCache is a cache for hash values of files
+type HashCache struct {
+	stats     hcStats      //first so that the counters are 64-bit aligned
+	lck       sync.RWMutex //protects hashtypes and watcher
+	shards    []hcShard    //entry table
+	opts      HashCacheOptions
+	hashtypes []string      //hash types to use (primary first)
+	fsys      fs.FS         //content source
+	dir       string        //content directory (empty if the content source is not a directory)
+	root      string        //absolute content directory with symlinks resolved
+	index     *hashIndex    //persistent hash index (nil if not used)
+	manifests manifestCache //parsed checksum manifests
+	hlck      sync.Mutex
+	byhash    map[string]string //reverse index (hash -> path of a file which had that hash)
+	watcher   *dirWatcher       //filesystem watcher (nil if not watching)
+	rch       chan *hcEnt       //entries to rehash in the background
+	done      chan struct{}     //closed when the HashCache is closed
 }
 
 //Get opens a file in the cache and also gets its hash and modification time
-func (hc *HashCache) Get(path string) (*os.File, *Hash, time.Time, error) {
-	//send request
-	var req hreq
-	req.name = path
-	req.lck.Lock()
-	hc.wch <- &req
-	req.lck.Lock()
-	he, err := req.he, req.err
+func (hc *HashCache) Get(path string) (fs.File, *Hash, time.Time, error) {
+	f, hashes, t, err := hc.GetAll(path)
 	if err != nil {
-		return nil, nil, time.Unix(0, 0), err
+		return nil, nil, t, err
 	}
-	hc.lck.RLock()
-	defer hc.lck.RUnlock()
-	f, err := os.Open(filepath.Join(hc.dir, path))
+	return f, hashes[0], t, nil
+}
+
+//number of times GetAll retries when the file is replaced while it is being hashed
+//after that the opened file itself is hashed, so the hashes always describe the bytes which are read from it
+const snapshotRetries = 2
+
+//ErrFileChanged is an error returned when a file keeps changing and a consistent snapshot can not be taken
+var ErrFileChanged = errors.New("File changed while hashing")
+
+//GetAll is like Get but returns the hashes of all configured hash types (primary first)
+//the hashes are guaranteed to match the content of the returned file (unless it is modified in place while being read)
+func (hc *HashCache) GetAll(path string) (fs.File, []*Hash, time.Time, error) {
+	return hc.getAll(path, -1)
+}
+
+//GetAllAsync is like GetAll, but does not wait for large files to be hashed
+//if the hashes of a file of at least minsize bytes are not cached, the file is returned with nil hashes and hashed in the background
+func (hc *HashCache) GetAllAsync(path string, minsize int64) (fs.File, []*Hash, time.Time, error) {
+	return hc.getAll(path, minsize)
+}
+
+//getAll implements GetAll and GetAllAsync (minsize is negative to always wait for the hashes)
+func (hc *HashCache) getAll(path string, minsize int64) (fs.File, []*Hash, time.Time, error) {
+	he, err := hc.lookup(path)
 	if err != nil {
 		return nil, nil, time.Unix(0, 0), err
 	}
-	h, err := he.getHash(hc.dir, hc.hashtype)
-	if err != nil {
+	for i := 0; ; i++ {
+		f, info, err := hc.open(path)
+		if err != nil {
+			return nil, nil, time.Unix(0, 0), err
+		}
+		if hashes := he.cached(hc, statID(info), true); hashes != nil {
+			return f, hashes, info.ModTime(), nil
+		}
+		if ch := he.refreshing(); ch != nil {
+			//the watcher noticed a change, and the file is already being rehashed in the background
+			if minsize >= 0 && info.Size() >= minsize {
+				return f, nil, info.ModTime(), nil
+			}
+			select {
+			case <-ch:
+			case <-hc.done:
+			}
+			if hashes := he.cached(hc, statID(info), false); hashes != nil {
+				return f, hashes, info.ModTime(), nil
+			}
+		}
+		if minsize >= 0 && info.Size() >= minsize && info.Mode().IsRegular() {
+			he.hashAsync(hc)
+			return f, nil, info.ModTime(), nil
+		}
+		hashes, id, err := he.getHashes(hc)
+		if err != nil {
+			f.Close()
+			return nil, nil, time.Unix(0, 0), err
+		}
+		if id == statID(info) {
+			return f, hashes, info.ModTime(), nil
+		}
+		//the hashes are of a different version of the file
+		if i == snapshotRetries {
+			hashtypes, _ := hc.config()
+			hashes, err = hashSnapshot(hashtypes, f)
+			if err != nil {
+				f.Close()
+				return nil, nil, time.Unix(0, 0), err
+			}
+			return f, hashes, info.ModTime(), nil
+		}
 		f.Close()
-		return nil, nil, time.Unix(0, 0), err
+		he.invalidate(hc)
+	}
+}
+
+//hashAsync hashes the file of an entry in the background (unless it is already being hashed)
+//a temporary entry is used, so that neither the entry nor the HashCache is locked while hashing
+func (e *hcEnt) hashAsync(hc *HashCache) {
+	if !atomic.CompareAndSwapInt32(&e.pending, 0, 1) {
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&e.pending, 0)
+		tmp := &hcEnt{file: e.file}
+		_, err := tmp.update(hc, false)
+		if err == nil {
+			e.adopt(hc, tmp)
+		}
+	}()
+}
+
+//cached returns the hashes of an entry without opening or hashing the file (nil unless they are current for the file with the given identity)
+//hit sets whether the lookup is counted as a hit or (if the caller waited for the file to be hashed) as a miss
+func (e *hcEnt) cached(hc *HashCache, id fileID, hit bool) []*Hash {
+	if atomic.LoadInt32(&e.pending) != 0 {
+		return nil
 	}
-	info, err := f.Stat()
+	hashtypes, _ := hc.config()
+	e.lck.Lock()
+	defer e.lck.Unlock()
+	if e.hashes == nil || !e.current(hashtypes) || e.id != id {
+		return nil
+	}
+	e.lastused = time.Now()
+	hc.stats.record(hit)
+	return e.hashes
+}
+
+//hashSnapshot hashes an opened file and rewinds it
+func hashSnapshot(hashtypes []string, f fs.File) ([]*Hash, error) {
+	sk, ok := f.(io.Seeker)
+	if !ok {
+		return nil, ErrFileChanged
+	}
+	hs := make([]hash.Hash, len(hashtypes))
+	ws := make([]io.Writer, len(hashtypes))
+	for i, t := range hashtypes {
+		hf := hashFunc(t)
+		if hf == nil {
+			return nil, ErrUnrecognizedHash
+		}
+		hs[i] = hf()
+		ws[i] = hs[i]
+	}
+	n, err := io.Copy(io.MultiWriter(ws...), f)
 	if err != nil {
-		f.Close()
-		return nil, nil, time.Unix(0, 0), err
+		return nil, err
 	}
-	return f, h, info.ModTime(), nil
-}
-
-func (hc *HashCache) server() {
-	etbl := make(map[string]*hcEnt)
-	prunetimer := time.NewTicker(time.Minute)
-	defer prunetimer.Stop()
-	ch := make(chan *hreq, 2)
-	hc.wch = ch
-	hc.lck.Unlock()
-	for {
-		select {
-		case <-prunetimer.C: //prune cache
-			for i, v := range etbl {
-				if v.shouldPrune() {
-					delete(etbl, i)
-				}
-			}
-		case r, ok := <-ch: //incoming request
-			if !ok { //channel closed, shutdown
-				return
+	_, err = sk.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	hashes := make([]*Hash, len(hashtypes))
+	for i, t := range hashtypes {
+		hashes[i] = &Hash{
+			HashType: t,
+			Hash:     hs[i].Sum(nil),
+			Len:      uint64(n),
+		}
+	}
+	return hashes, nil
+}
+
+//addHashes adds the hashes of a file to the reverse index
+func (hc *HashCache) addHashes(path string, hashes []*Hash) {
+	hc.hlck.Lock()
+	defer hc.hlck.Unlock()
+	for _, h := range hashes {
+		hc.byhash[h.String()] = path
+	}
+}
+
+//setHashes replaces the hashes of an entry in the reverse index (nothing is added for removed entries)
+func (hc *HashCache) setHashes(e *hcEnt, hashes []*Hash) {
+	hc.hlck.Lock()
+	defer hc.hlck.Unlock()
+	hc.unindex(e)
+	if e.removed {
+		return
+	}
+	for _, h := range hashes {
+		hc.byhash[h.String()] = e.file
+	}
+	e.indexed = hashes
+}
+
+//unindex removes the hashes of an entry from the reverse index unless another file has taken them over (must be called with hc.hlck held)
+func (hc *HashCache) unindex(e *hcEnt) {
+	for _, h := range e.indexed {
+		hstr := h.String()
+		if hc.byhash[hstr] == e.file {
+			delete(hc.byhash, hstr)
+		}
+	}
+	e.indexed = nil
+}
+
+//GetByHash opens a file with the given hash (one of the configured hash types)
+//only files which have been hashed (since startup, or recorded in the persistent index) can be found
+func (hc *HashCache) GetByHash(h Hash) (fs.File, []*Hash, time.Time, error) {
+	hstr := h.String()
+	notfound := &fs.PathError{Op: "open", Path: hstr, Err: fs.ErrNotExist}
+	hc.hlck.Lock()
+	p, ok := hc.byhash[hstr]
+	hc.hlck.Unlock()
+	if !ok {
+		return nil, nil, time.Unix(0, 0), notfound
+	}
+	f, hashes, t, err := hc.GetAll(p)
+	if err == nil {
+		for _, v := range hashes {
+			if v.String() == hstr {
+				return f, hashes, t, nil
 			}
-			func() { //process request
-				defer r.lck.Unlock()
-				if etbl[r.name] == nil {
-					hc.lck.RLock()
-					defer hc.lck.RUnlock()
-					_, err := os.Stat(filepath.Join(hc.dir, r.name))
-					if err != nil {
-						r.err = err
-						return
-					}
-					he := new(hcEnt)
-					he.lastused = time.Now()
-					he.timestamp = time.Unix(0, 0) //set timestamp to epoch so it is invalid
-					r.he = he
-					etbl[r.name] = he
-				} else {
-					r.he = etbl[r.name]
-				}
-			}()
 		}
+		f.Close()
+		err = notfound
+	}
+	if os.IsNotExist(err) {
+		//the file changed or was removed
+		hc.hlck.Lock()
+		if hc.byhash[hstr] == p {
+			delete(hc.byhash, hstr)
+		}
+		hc.hlck.Unlock()
+		err = notfound
+	}
+	return nil, nil, time.Unix(0, 0), err
+}
+
+//GetChunks gets the content-defined chunk list and hash of a file
+func (hc *HashCache) GetChunks(path string) (*ChunkList, *Hash, error) {
+	he, err := hc.lookup(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return he.getChunks(hc)
+}
+
+//GetBlocks gets the block list and hash of a file (requires a merkle hash type)
+func (hc *HashCache) GetBlocks(path string) (*BlockList, *Hash, error) {
+	he, err := hc.lookup(path)
+	if err != nil {
+		return nil, nil, err
 	}
+	return he.getBlocks(hc)
 }
 
 //Close closes a HashCache
 func (hc *HashCache) Close() {
-	close(hc.wch)
+	close(hc.done)
+	hc.lck.RLock()
+	defer hc.lck.RUnlock()
+	if hc.watcher != nil {
+		hc.watcher.close()
+	}
+	if hc.index != nil {
+		hc.index.close()
+	}
+}
+
+//ErrWatchUnsupported is an error returned when filesystem watching is not supported on this platform (or content source)
+var ErrWatchUnsupported = errors.New("Filesystem watching not supported")
+
+//Watch starts watching the content directory for changes
+//cached hashes are then trusted without checking the file, and changed files which are already known are rehashed in the background
+//GetAll waits for such a rehash instead of hashing the file itself, and GetAllAsync returns large files without hashes until it is done
+func (hc *HashCache) Watch() error {
+	hc.lck.Lock()
+	defer hc.lck.Unlock()
+	if hc.watcher != nil {
+		return nil
+	}
+	if hc.dir == "" {
+		return ErrWatchUnsupported
+	}
+	w, err := newDirWatcher(hc.dir)
+	if err != nil {
+		return err
+	}
+	hc.watcher = w
+	go w.run(func(p string, tree bool) { //file changed
+		if tree {
+			//rehash everything under the path on the next request
+			hc.invalidateTree(p)
+			return
+		}
+		if he := hc.find(p); he != nil {
+			hc.queueRefresh(he)
+		}
+	})
+	for i := 0; i < 2; i++ {
+		go func() { //background rehash worker
+			for {
+				select {
+				case he := <-hc.rch:
+					he.refresh(hc)
+				case <-hc.done:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+//queueRefresh queues a changed entry to be rehashed in the background
+func (hc *HashCache) queueRefresh(e *hcEnt) {
+	e.lck.Lock()
+	if e.refreshes == 0 {
+		e.refreshed = make(chan struct{})
+	}
+	e.refreshes++
+	e.lck.Unlock()
+	select {
+	case hc.rch <- e:
+	default: //rehash queue full - rehash on next request
+		e.refreshDone()
+		e.invalidate(hc)
+	}
 }
 
 //SetHashType sets the hash type
 func (hc *HashCache) SetHashType(hashtype string) error {
-	if hashreg[hashtype] == nil {
+	return hc.SetHashTypes(hashtype)
+}
+
+//SetHashTypes sets several hash types which are computed together (the first one is the primary hash type)
+func (hc *HashCache) SetHashTypes(hashtypes ...string) error {
+	if len(hashtypes) == 0 {
 		return ErrUnrecognizedHash
 	}
+	for _, t := range hashtypes {
+		err := CheckHashType(t)
+		if err != nil {
+			return err
+		}
+	}
 	hc.lck.Lock()
 	defer hc.lck.Unlock()
-	hc.hashtype = hashtype
+	hc.hashtypes = append([]string(nil), hashtypes...)
 	return nil
 }
 
+//HashTypes returns the hash types in use (the primary hash type first)
+func (hc *HashCache) HashTypes() []string {
+	hc.lck.RLock()
+	defer hc.lck.RUnlock()
+	return append([]string(nil), hc.hashtypes...)
+}
+
+//Stats returns statistics about the HashCache
+func (hc *HashCache) Stats() HashCacheStats {
+	return HashCacheStats{
+		Entries:     int(atomic.LoadInt64(&hc.stats.entries)),
+		Hits:        atomic.LoadUint64(&hc.stats.hits),
+		Misses:      atomic.LoadUint64(&hc.stats.misses),
+		Evictions:   atomic.LoadUint64(&hc.stats.evictions),
+		Expirations: atomic.LoadUint64(&hc.stats.expirations),
+		Mismatches:  atomic.LoadUint64(&hc.stats.mismatches),
+	}
+}
+
 //NewHashCache creates a new HashCache (default hash type currently sha256 but dont rely on that)
 func NewHashCache(dir string) (*HashCache, error) {
+	return NewHashCacheWithOptions(dir, HashCacheOptions{})
+}
+
+//NewHashCacheWithOptions creates a new HashCache with the given options
+func NewHashCacheWithOptions(dir string, opts HashCacheOptions) (*HashCache, error) {
 	if _, err := os.Stat(dir); err != nil { //check that we can access the dir
 		return nil, err
 	}
+	return newHashCache(os.DirFS(dir), dir, opts)
+}
+
+//NewHashCacheFS creates a new HashCache which serves content from fsys (e.g. an embed.FS or a zip archive)
+//modification times are taken from fs.FileInfo, and watching is not supported
+func NewHashCacheFS(fsys fs.FS, opts HashCacheOptions) (*HashCache, error) {
+	return newHashCache(fsys, "", opts)
+}
+
+func newHashCache(fsys fs.FS, dir string, opts HashCacheOptions) (*HashCache, error) {
+	if opts.MaxEntries < 0 || (opts.Eviction != EvictLRU && opts.Eviction != EvictLFU) || opts.VerifyRate < 0 || opts.VerifyRate > 1 ||
+		opts.Paths.Symlinks < SymlinkWithinRoot || opts.Paths.Symlinks > SymlinkDeny {
+		return nil, errors.New("invalid hash cache options")
+	}
+	if opts.TTL == 0 {
+		opts.TTL = defaultTTL
+	}
 	hc := new(HashCache)
-	hc.hashtype = "sha256"
+	hc.opts = opts
+	if dir != "" {
+		root, err := filepath.Abs(dir)
+		if err == nil {
+			root, err = filepath.EvalSymlinks(root)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hc.root = root
+	}
+	if opts.Index != "" {
+		idx, err := openIndex(opts.Index, hc.logErr)
+		if err != nil {
+			return nil, err
+		}
+		hc.index = idx
+	}
+	hc.byhash = make(map[string]string)
+	if hc.index != nil {
+		hc.index.each(hc.addHashes)
+	}
+	hc.hashtypes = []string{"sha256"}
+	hc.fsys = fsys
 	hc.dir = dir
-	hc.lck.Lock()
-	hc.server()
-	hc.lck.Lock() //wait for server startup
-	hc.lck.Unlock()
+	hc.initShards()
+	hc.rch = make(chan *hcEnt, 64)
+	hc.done = make(chan struct{})
+	if opts.TTL > 0 {
+		go hc.pruner()
+	}
 	return hc, nil
 }
@@ -0,0 +1,474 @@
+package dcdn
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+//testDir creates a temp dir with files named f0, f1...
+func testDir(t *testing.T, n int) string {
+	dir, err := ioutil.TempDir("", "dcdnhc")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	for i := 0; i < n; i++ {
+		ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), []byte(fmt.Sprintf("file %d", i)), 0600)
+	}
+	return dir
+}
+
+func testGet(t *testing.T, hc *HashCache, path string) {
+	f, _, _, err := hc.Get(path)
+	if err != nil {
+		t.Fatalf("Failed to get %q: %q\n", path, err.Error())
+	}
+	f.Close()
+}
+
+func TestHashCacheEviction(t *testing.T) {
+	dir := testDir(t, 4)
+	defer os.RemoveAll(dir)
+	tbl := []struct {
+		policy  EvictionPolicy
+		uses    []string
+		evicted string //file which should have been evicted after accessing f3
+	}{
+		{EvictLRU, []string{"/f0", "/f1", "/f2", "/f0", "/f1"}, "/f2"},
+		{EvictLFU, []string{"/f0", "/f1", "/f2", "/f0", "/f2", "/f0", "/f2", "/f1"}, "/f1"},
+	}
+	for _, v := range tbl {
+		hc, err := NewHashCacheWithOptions(dir, HashCacheOptions{
+			MaxEntries: 3,
+			Eviction:   v.policy,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+		}
+		for _, p := range v.uses {
+			testGet(t, hc, p)
+		}
+		testGet(t, hc, "/f3")
+		st := hc.Stats()
+		if st.Entries != 3 || st.Evictions != 1 {
+			hc.Close()
+			t.Fatalf("[%s] Unexpected stats: %+v\n", v.policy, st)
+		}
+		//the evicted file has to be hashed again, everything else is a hit
+		for i := 0; i < 4; i++ {
+			p := fmt.Sprintf("/f%d", i)
+			before := hc.Stats()
+			testGet(t, hc, p)
+			after := hc.Stats()
+			miss := after.Misses > before.Misses
+			if miss != (p == v.evicted) {
+				hc.Close()
+				t.Fatalf("[%s] Unexpected miss status for %q: %v\n", v.policy, p, miss)
+			}
+			if p == v.evicted {
+				break //further gets would evict more entries
+			}
+		}
+		hc.Close()
+	}
+}
+
+func TestHashCacheStats(t *testing.T) {
+	dir := testDir(t, 2)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	testGet(t, hc, "/f0")
+	testGet(t, hc, "/f0")
+	testGet(t, hc, "/f1")
+	testGet(t, hc, "/f0")
+	_, _, _, err = hc.Get("/missing")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error but got %v\n", err)
+	}
+	st := hc.Stats()
+	if st != (HashCacheStats{Entries: 2, Hits: 2, Misses: 2}) {
+		t.Fatalf("Unexpected stats: %+v\n", st)
+	}
+}
+
+func TestHashCacheTTL(t *testing.T) {
+	dir := testDir(t, 1)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCacheWithOptions(dir, HashCacheOptions{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	testGet(t, hc, "/f0")
+	deadline := time.Now().Add(5 * time.Second)
+	for hc.Stats().Expirations == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Entry did not expire: %+v\n", hc.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := hc.Stats(); st.Entries != 0 || st.Evictions != 0 {
+		t.Fatalf("Unexpected stats: %+v\n", st)
+	}
+}
+
+func TestHashCacheReverseIndex(t *testing.T) {
+	dir := testDir(t, 10)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCacheWithOptions(dir, HashCacheOptions{MaxEntries: 2, TTL: time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	size := func() int {
+		hc.hlck.Lock()
+		defer hc.hlck.Unlock()
+		return len(hc.byhash)
+	}
+	//the reverse index does not keep the hashes of evicted entries
+	for i := 0; i < 10; i++ {
+		testGet(t, hc, fmt.Sprintf("/f%d", i))
+	}
+	if n := size(); n != 2 {
+		t.Fatalf("Reverse index has %d hashes after eviction\n", n)
+	}
+	//or old hashes of rehashed files
+	h0 := quickHash(t, []byte("file 9"))
+	ioutil.WriteFile(filepath.Join(dir, "f9"), []byte("changed"), 0600)
+	os.Chtimes(filepath.Join(dir, "f9"), time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	testGet(t, hc, "/f9")
+	if n := size(); n != 2 {
+		t.Fatalf("Reverse index has %d hashes after rehashing\n", n)
+	}
+	if _, _, _, err := hc.GetByHash(h0); !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error for the old hash but got %v\n", err)
+	}
+	f, _, _, err := hc.GetByHash(quickHash(t, []byte("changed")))
+	if err != nil {
+		t.Fatalf("Failed to get the new hash: %v\n", err)
+	}
+	f.Close()
+}
+
+func TestHashCacheBlocks(t *testing.T) {
+	dir := testDir(t, 1)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	hc.SetHashTypes("sha256", "merkle-sha256")
+	//block lists are only generated when they are requested
+	testGet(t, hc, "/f0")
+	if he := hc.find("/f0"); he == nil || he.blocks != nil {
+		t.Fatalf("Block list generated while hashing\n")
+	}
+	for _, dat := range []string{"file 0", "changed"} {
+		ioutil.WriteFile(filepath.Join(dir, "f0"), []byte(dat), 0600)
+		mt := time.Now().Add(time.Duration(len(dat)) * time.Minute)
+		os.Chtimes(filepath.Join(dir, "f0"), mt, mt)
+		bl, h, err := hc.GetBlocks("/f0")
+		if err != nil {
+			t.Fatalf("Failed to get block list: %q\n", err.Error())
+		}
+		expect, err := GenHash("merkle-sha256", func(w io.Writer) (uint64, error) {
+			n, err := w.Write([]byte(dat))
+			return uint64(n), err
+		})
+		if err != nil || h.String() != expect.String() || bl.Check(*h) != nil {
+			t.Fatalf("[%s] Bad block list: %v %v\n", dat, h, err)
+		}
+	}
+}
+
+func TestHashCacheFS(t *testing.T) {
+	mt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	dat := make([]byte, 100000)
+	for i := range dat {
+		dat[i] = byte(i*7 + i/1000)
+	}
+	fsys := fstest.MapFS{
+		"a/b.txt": &fstest.MapFile{Data: []byte("hello"), ModTime: mt},
+		"big":     &fstest.MapFile{Data: dat, ModTime: mt},
+	}
+	hc, err := NewHashCacheFS(fsys, HashCacheOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	if hc.Watch() != ErrWatchUnsupported {
+		t.Fatalf("Expected watching an fs.FS to be unsupported\n")
+	}
+	f, h, tm, err := hc.Get("/a/./b.txt")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	if h.String() != quickHash(t, []byte("hello")).String() || !tm.Equal(mt) {
+		t.Fatalf("Bad hash or modification time: %q %s\n", h.String(), tm)
+	}
+	_, _, _, err = hc.Get("/../a/missing")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected not exist error but got %v\n", err)
+	}
+	//serve through a FileServer
+	srv := httptest.NewServer(FileServer{HashCache: hc})
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/a/b.txt")
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" || resp.Header.Get("X-DCDN-HASH") != h.String() || resp.Header.Get("Last-Modified") != mt.Format(http.TimeFormat) {
+		t.Fatalf("Bad response: %q %v\n", body, resp.Header)
+	}
+	cl, _, err := hc.GetChunks("/big")
+	if err != nil {
+		t.Fatalf("Failed to get chunks: %q\n", err.Error())
+	}
+	c := cl.Chunks[1]
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/big", nil)
+	req.Header.Set("X-DCDN-CHUNK", c.Hash.String())
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(body, dat[c.Offset:c.Offset+c.Hash.Len]) {
+		t.Fatalf("Bad chunk data\n")
+	}
+}
+
+//changingFS is an fs.FS where the file changes every time it is opened
+type changingFS struct {
+	lck sync.Mutex
+	n   int
+}
+
+func (c *changingFS) Open(name string) (fs.File, error) {
+	c.lck.Lock()
+	defer c.lck.Unlock()
+	c.n++
+	return fstest.MapFS{
+		"file": &fstest.MapFile{
+			Data:    []byte(fmt.Sprintf("version %d", c.n)),
+			ModTime: time.Unix(int64(c.n), 0),
+		},
+	}.Open(name)
+}
+
+func TestHashCacheSnapshot(t *testing.T) {
+	//file replaced while the entry is cached
+	dir := testDir(t, 1)
+	defer os.RemoveAll(dir)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	hc.watcher = new(dirWatcher) //pretend to watch so that cached hashes are trusted without a stat
+	check := func(hc *HashCache, p string) string {
+		f, h, _, err := hc.Get(p)
+		if err != nil {
+			t.Fatalf("Failed to get file: %q\n", err.Error())
+		}
+		defer f.Close()
+		dat, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatalf("Failed to read file: %q\n", err.Error())
+		}
+		if h.String() != quickHash(t, dat).String() {
+			t.Fatalf("Hash %q does not match content %q\n", h.String(), dat)
+		}
+		return string(dat)
+	}
+	check(hc, "/f0")
+	tmp := filepath.Join(dir, "tmp")
+	ioutil.WriteFile(tmp, []byte("replaced content"), 0600)
+	os.Rename(tmp, filepath.Join(dir, "f0"))
+	if check(hc, "/f0") != "replaced content" {
+		t.Fatalf("Replaced file not served\n")
+	}
+	//file which changes on every open
+	hc2, err := NewHashCacheFS(new(changingFS), HashCacheOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc2.Close()
+	check(hc2, "/file")
+}
+
+//benchHashCache creates a HashCache with n hashed files
+func benchHashCache(b *testing.B, n int) (*HashCache, []string, func()) {
+	dir, err := ioutil.TempDir("", "dcdnbench")
+	if err != nil {
+		b.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("/f%d", i)
+		ioutil.WriteFile(filepath.Join(dir, paths[i][1:]), []byte(paths[i]), 0600)
+	}
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		b.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	for _, p := range paths {
+		f, _, _, err := hc.Get(p)
+		if err != nil {
+			b.Fatalf("Failed to get file: %q\n", err.Error())
+		}
+		f.Close()
+	}
+	return hc, paths, func() {
+		hc.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+//BenchmarkHashCacheLookup measures concurrent entry lookups (run with -cpu 1,2,4,8 to see scaling)
+func BenchmarkHashCacheLookup(b *testing.B) {
+	hc, paths, done := benchHashCache(b, 1024)
+	defer done()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			_, err := hc.lookup(paths[i%len(paths)])
+			if err != nil {
+				b.Fatalf("Lookup failed: %q\n", err.Error())
+			}
+			i++
+		}
+	})
+}
+
+//BenchmarkHashCacheGet measures concurrent Gets of cached files (run with -cpu 1,2,4,8 to see scaling)
+func BenchmarkHashCacheGet(b *testing.B) {
+	hc, paths, done := benchHashCache(b, 1024)
+	defer done()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			f, _, _, err := hc.Get(paths[i%len(paths)])
+			if err != nil {
+				b.Fatalf("Get failed: %q\n", err.Error())
+			}
+			f.Close()
+			i++
+		}
+	})
+}
+
+//BenchmarkHashCacheGetSame measures concurrent Gets of a single file
+func BenchmarkHashCacheGetSame(b *testing.B) {
+	hc, paths, done := benchHashCache(b, 1)
+	defer done()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			f, _, _, err := hc.Get(paths[0])
+			if err != nil {
+				b.Fatalf("Get failed: %q\n", err.Error())
+			}
+			f.Close()
+		}
+	})
+}
+
+//gateFS is an fs.FS which counts opens and blocks reads of "big" until the gate is opened
+type gateFS struct {
+	fstest.MapFS
+	gate  chan struct{}
+	lck   sync.Mutex
+	opens map[string]int
+}
+
+type gatedFile struct {
+	fs.File
+	gate chan struct{}
+}
+
+func (f gatedFile) Read(dat []byte) (int, error) {
+	<-f.gate
+	return f.File.Read(dat)
+}
+
+func (g *gateFS) Open(name string) (fs.File, error) {
+	g.lck.Lock()
+	g.opens[name]++
+	g.lck.Unlock()
+	f, err := g.MapFS.Open(name)
+	if err != nil || name != "big" {
+		return f, err
+	}
+	return gatedFile{f, g.gate}, nil
+}
+
+func TestGetAllAsyncNoStall(t *testing.T) {
+	g := &gateFS{
+		MapFS: fstest.MapFS{
+			"big":   &fstest.MapFile{Data: make([]byte, 4096)},
+			"small": &fstest.MapFile{Data: []byte("small")},
+		},
+		gate:  make(chan struct{}),
+		opens: make(map[string]int),
+	}
+	hc, err := NewHashCacheFS(g, HashCacheOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	defer close(g.gate)
+	f, hashes, _, err := hc.GetAllAsync("/big", 1024)
+	if err != nil || hashes != nil {
+		t.Fatalf("Expected the big file without hashes: %v %v\n", hashes, err)
+	}
+	f.Close()
+	//the background hash is stuck on the gate - nothing else may wait for it
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		hc.SetHashTypes("sha256", "sha512")
+		testGet(t, hc, "/small")
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Requests stalled while a file was hashed in the background\n")
+	}
+	//small files are only opened once per request
+	g.lck.Lock()
+	before := g.opens["small"]
+	g.lck.Unlock()
+	f, hashes, _, err = hc.GetAllAsync("/small", 1024)
+	if err != nil || hashes == nil {
+		t.Fatalf("Expected hashes of the small file: %v\n", err)
+	}
+	f.Close()
+	g.lck.Lock()
+	after := g.opens["small"]
+	g.lck.Unlock()
+	if after != before+1 {
+		t.Fatalf("Small file opened %d times\n", after-before)
+	}
+}
@@ -0,0 +1,295 @@
+package dcdn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+//magic header of an index file (includes the format version)
+const indexMagic = "DCDNIDX\x01"
+
+//ErrCorruptIndex is an error returned when an index record fails to decode
+var ErrCorruptIndex = errors.New("Corrupt hash index")
+
+var indexCRC = crc32.MakeTable(crc32.Castagnoli)
+
+//maximum size of an index record (larger lengths indicate corruption)
+const indexMaxRecord = 1 << 20
+
+//file identity used to decide whether an indexed hash is still valid
+type fileID struct {
+	size  uint64
+	mtime int64 //modification time in unix nanoseconds
+	inode uint64
+}
+
+func statID(inf os.FileInfo) fileID {
+	return fileID{
+		size:  uint64(inf.Size()),
+		mtime: inf.ModTime().UnixNano(),
+		inode: fileInode(inf),
+	}
+}
+
+//index entry
+type idxEnt struct {
+	id     fileID
+	hashes []*Hash
+}
+
+//hashIndex is a persistent append-only index of file hashes
+//records are length-prefixed and checksummed, and the log is compacted when it is loaded
+type hashIndex struct {
+	lck  sync.Mutex
+	f    *os.File
+	ents map[string]idxEnt
+}
+
+//encodeRecord encodes an index record
+func encodeRecord(path string, e idxEnt) ([]byte, error) {
+	buf := appendUvarint(nil, uint64(len(path)))
+	buf = append(buf, path...)
+	buf = appendUvarint(buf, e.id.size)
+	buf = appendUvarint(buf, uint64(e.id.mtime))
+	buf = appendUvarint(buf, e.id.inode)
+	buf = appendUvarint(buf, uint64(len(e.hashes)))
+	for _, h := range e.hashes {
+		hb, err := h.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(len(hb)))
+		buf = append(buf, hb...)
+	}
+	rec := make([]byte, 4, 8+len(buf))
+	binary.BigEndian.PutUint32(rec, uint32(len(buf)))
+	rec = append(rec, buf...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.Checksum(buf, indexCRC))
+	return append(rec, crc[:]...), nil
+}
+
+//decodeRecord decodes the payload of an index record
+func decodeRecord(dat []byte) (string, idxEnt, error) {
+	var e idxEnt
+	uv := func() (uint64, error) {
+		v, n := binary.Uvarint(dat)
+		if n <= 0 {
+			return 0, ErrCorruptIndex
+		}
+		dat = dat[n:]
+		return v, nil
+	}
+	field := func() ([]byte, error) {
+		l, err := uv()
+		if err != nil || uint64(len(dat)) < l {
+			return nil, ErrCorruptIndex
+		}
+		f := dat[:l]
+		dat = dat[l:]
+		return f, nil
+	}
+	path, err := field()
+	if err != nil {
+		return "", e, err
+	}
+	var mtime, n uint64
+	for _, p := range []*uint64{&e.id.size, &mtime, &e.id.inode, &n} {
+		*p, err = uv()
+		if err != nil {
+			return "", e, err
+		}
+	}
+	e.id.mtime = int64(mtime)
+	for i := uint64(0); i < n; i++ {
+		hb, err := field()
+		if err != nil {
+			return "", e, err
+		}
+		h := new(Hash)
+		err = h.UnmarshalBinary(hb)
+		if err != nil {
+			return "", e, err
+		}
+		e.hashes = append(e.hashes, h)
+	}
+	if len(dat) != 0 {
+		return "", e, ErrCorruptIndex
+	}
+	return string(path), e, nil
+}
+
+//readIndex reads index records until EOF or the first corrupt record
+func readIndex(r io.Reader, ents map[string]idxEnt) error {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(indexMagic))
+	_, err := io.ReadFull(br, magic)
+	if err == io.EOF {
+		return nil //empty index
+	}
+	if err != nil || string(magic) != indexMagic {
+		return ErrCorruptIndex
+	}
+	for {
+		var hdr [4]byte
+		_, err = io.ReadFull(br, hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return ErrCorruptIndex
+		}
+		l := binary.BigEndian.Uint32(hdr[:])
+		if l > indexMaxRecord {
+			return ErrCorruptIndex
+		}
+		rec := make([]byte, l+4)
+		_, err = io.ReadFull(br, rec)
+		if err != nil {
+			return ErrCorruptIndex
+		}
+		payload := rec[:len(rec)-4]
+		if crc32.Checksum(payload, indexCRC) != binary.BigEndian.Uint32(rec[len(rec)-4:]) {
+			return ErrCorruptIndex
+		}
+		path, e, err := decodeRecord(payload)
+		if err == ErrUnrecognizedHash {
+			continue //hash type no longer registered
+		}
+		if err != nil {
+			return ErrCorruptIndex
+		}
+		ents[path] = e
+	}
+}
+
+//openIndex loads an index file (creating it if necessary) and compacts it
+//corrupt records are reported to logErr and everything after them is discarded
+func openIndex(path string, logErr func(error)) (*hashIndex, error) {
+	ents := make(map[string]idxEnt)
+	f, err := os.Open(path)
+	switch {
+	case err == nil:
+		err = readIndex(f, ents)
+		f.Close()
+		if err != nil {
+			logErr(fmt.Errorf("hash index %q is corrupt, keeping %d valid entries: %w", path, len(ents), err))
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	//write compacted index
+	tmp := path + ".tmp"
+	nf, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		bw := bufio.NewWriter(nf)
+		_, err := bw.WriteString(indexMagic)
+		if err != nil {
+			return err
+		}
+		for p, e := range ents {
+			rec, err := encodeRecord(p, e)
+			if err != nil {
+				return err
+			}
+			_, err = bw.Write(rec)
+			if err != nil {
+				return err
+			}
+		}
+		err = bw.Flush()
+		if err != nil {
+			return err
+		}
+		return nf.Sync()
+	}()
+	nf.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return nil, err
+	}
+	f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &hashIndex{
+		f:    f,
+		ents: ents,
+	}, nil
+}
+
+//lookup finds indexed hashes of a file (in the order of hashtypes)
+func (idx *hashIndex) lookup(path string, id fileID, hashtypes []string) []*Hash {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+	e, ok := idx.ents[path]
+	if !ok || e.id != id {
+		return nil
+	}
+	hashes := make([]*Hash, len(hashtypes))
+	for i, t := range hashtypes {
+		for _, h := range e.hashes {
+			if h.HashType == t {
+				hashes[i] = h
+			}
+		}
+		if hashes[i] == nil {
+			return nil
+		}
+	}
+	return hashes
+}
+
+//store records the hashes of a file
+func (idx *hashIndex) store(path string, id fileID, hashes []*Hash) error {
+	e := idxEnt{
+		id:     id,
+		hashes: hashes,
+	}
+	rec, err := encodeRecord(path, e)
+	if err != nil {
+		return err
+	}
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+	if idx.f == nil {
+		return errors.New("index closed")
+	}
+	idx.ents[path] = e
+	_, err = idx.f.Write(rec)
+	return err
+}
+
+//each calls fn with every indexed file
+func (idx *hashIndex) each(fn func(path string, hashes []*Hash)) {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+	for p, e := range idx.ents {
+		fn(p, e.hashes)
+	}
+}
+
+//close closes the index file
+func (idx *hashIndex) close() error {
+	idx.lck.Lock()
+	defer idx.lck.Unlock()
+	if idx.f == nil {
+		return nil
+	}
+	err := idx.f.Close()
+	idx.f = nil
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package dcdn
+
+import "os"
+
+//fileInode gets the inode number of a file (not available on this platform)
+func fileInode(inf os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,138 @@
+package dcdn
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnidx")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	ipath := filepath.Join(dir, "index")
+	h1 := quickHash(t, []byte("first"))
+	h2 := quickHash(t, []byte("second"))
+	id := fileID{size: 5, mtime: 1234, inode: 7}
+	var logged []error
+	logErr := func(err error) {
+		logged = append(logged, err)
+	}
+	//write some records
+	idx, err := openIndex(ipath, logErr)
+	if err != nil {
+		t.Fatalf("Failed to open index: %q\n", err.Error())
+	}
+	if idx.store("/a", id, []*Hash{&h1}) != nil || idx.store("/b", id, []*Hash{&h1}) != nil || idx.store("/a", id, []*Hash{&h2}) != nil {
+		t.Fatal("Failed to store index records\n")
+	}
+	idx.close()
+	//reload
+	idx, err = openIndex(ipath, logErr)
+	if err != nil {
+		t.Fatalf("Failed to reopen index: %q\n", err.Error())
+	}
+	if hs := idx.lookup("/a", id, []string{"sha256"}); hs == nil || hs[0].String() != h2.String() {
+		t.Fatalf("Bad lookup result: %v\n", hs)
+	}
+	if hs := idx.lookup("/a", fileID{size: 5, mtime: 1235, inode: 7}, []string{"sha256"}); hs != nil {
+		t.Fatal("Lookup matched a modified file\n")
+	}
+	if hs := idx.lookup("/a", id, []string{"sha512"}); hs != nil {
+		t.Fatal("Lookup matched a missing hash type\n")
+	}
+	idx.close()
+	//corrupt the tail of the index
+	dat, err := ioutil.ReadFile(ipath)
+	if err != nil {
+		t.Fatalf("Failed to read index: %q\n", err.Error())
+	}
+	err = ioutil.WriteFile(ipath, append(dat, 0, 0, 0, 9, 1, 2, 3), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write index: %q\n", err.Error())
+	}
+	idx, err = openIndex(ipath, logErr)
+	if err != nil {
+		t.Fatalf("Failed to open corrupt index: %q\n", err.Error())
+	}
+	if len(idx.ents) != 2 {
+		t.Fatalf("Expected 2 entries after recovery but got %d\n", len(idx.ents))
+	}
+	if len(logged) != 1 || !errors.Is(logged[0], ErrCorruptIndex) {
+		t.Fatalf("Expected the corruption to be reported but got %v\n", logged)
+	}
+	idx.close()
+	//flip a bit in a record
+	dat[len(dat)-6] ^= 1
+	ioutil.WriteFile(ipath, dat, 0600)
+	idx, err = openIndex(ipath, logErr)
+	if err != nil {
+		t.Fatalf("Failed to open corrupt index: %q\n", err.Error())
+	}
+	if len(idx.ents) != 1 {
+		t.Fatalf("Expected 1 entry after recovery but got %d\n", len(idx.ents))
+	}
+	idx.close()
+}
+
+func TestHashCacheIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnidx")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	content := filepath.Join(dir, "content")
+	os.Mkdir(content, 0700)
+	ioutil.WriteFile(filepath.Join(content, "file"), []byte("indexed content"), 0600)
+	ipath := filepath.Join(dir, "index")
+	hc, err := NewHashCacheWithOptions(content, HashCacheOptions{Index: ipath})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	f, h, _, err := hc.Get("/file")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	hc.Close()
+	//a new cache should load the hash from the index
+	hc, err = NewHashCacheWithOptions(content, HashCacheOptions{Index: ipath})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	if len(hc.index.ents) != 1 {
+		t.Fatalf("Expected 1 index entry but got %d\n", len(hc.index.ents))
+	}
+	f, h2, _, err := hc.Get("/file")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	if h2 != hc.index.ents["/file"].hashes[0] || h2.String() != h.String() {
+		t.Fatalf("Hash not loaded from index: %q => %q\n", h.String(), h2.String())
+	}
+	//failed index updates are reported to the error logger
+	var logged []error
+	hc2, err := NewHashCacheWithOptions(content, HashCacheOptions{
+		Index:     filepath.Join(dir, "index2"),
+		ErrLogger: func(err error) { logged = append(logged, err) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc2.Close()
+	hc2.index.close()
+	f, _, _, err = hc2.Get("/file")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	if len(logged) != 1 {
+		t.Fatalf("Expected 1 logged error but got %v\n", logged)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package dcdn
+
+import (
+	"os"
+	"syscall"
+)
+
+//fileInode gets the inode number of a file
+func fileInode(inf os.FileInfo) uint64 {
+	if st, ok := inf.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,179 @@
+package dcdn
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"strings"
+)
+
+//SRI hash types in order of increasing strength (from the W3C SRI spec)
+var sritypes = []string{"sha256", "sha384", "sha512"}
+
+//add hash functions needed for interop
+func init() {
+	RegisterHash("sha384", func() hash.Hash {
+		return sha512.New384()
+	})
+	SetHashStrength("sha384", 192)
+	RegisterMultihash("sha256", 0x12)
+	RegisterMultihash("sha512", 0x13)
+	RegisterMultihash("sha384", 0x20)
+	RegisterHashAlias("sha2-256", "sha256")
+	RegisterHashAlias("sha2-384", "sha384")
+	RegisterHashAlias("sha2-512", "sha512")
+}
+
+//ErrNoInterop is an error returned when a hash type cannot be represented in the requested format
+var ErrNoInterop = errors.New("Hash type not supported by format")
+
+//ErrDigestLength is an error returned when a digest does not have the output size of its hash function
+var ErrDigestLength = errors.New("Digest length does not match hash function")
+
+//checkDigest checks that a digest has the output size of a hash function
+func checkDigest(htype string, dat []byte) error {
+	hf := hashFunc(htype)
+	if hf == nil {
+		return ErrUnrecognizedHash
+	}
+	if len(dat) != hf().Size() {
+		return ErrDigestLength
+	}
+	return nil
+}
+
+//ParseSRI parses a W3C Subresource Integrity string (e.g. "sha256-<base64>")
+//SRI does not carry a length, so the content length must be supplied
+//if the string contains multiple hashes, the strongest supported one is used
+func ParseSRI(str string, length uint64) (*Hash, error) {
+	var best *Hash
+	bestrank := -1
+	for _, ent := range strings.Fields(str) {
+		//strip options
+		if i := strings.IndexByte(ent, '?'); i != -1 {
+			ent = ent[:i]
+		}
+		i := strings.IndexByte(ent, '-')
+		if i == -1 {
+			continue
+		}
+		htype := ent[:i]
+		rank := -1
+		for j, v := range sritypes {
+			if v == htype {
+				rank = j
+			}
+		}
+		if rank <= bestrank {
+			continue
+		}
+		hdat, err := base64.StdEncoding.DecodeString(ent[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		err = checkDigest(htype, hdat)
+		if err != nil {
+			return nil, err
+		}
+		best = &Hash{
+			HashType: htype,
+			Hash:     hdat,
+			Len:      length,
+		}
+		bestrank = rank
+	}
+	if best == nil {
+		if strings.TrimSpace(str) == "" {
+			return nil, ErrInvalid
+		}
+		return nil, ErrUnrecognizedHash
+	}
+	return best, nil
+}
+
+//SRI serializes a hash as a W3C Subresource Integrity string (format type-valuebase64)
+func (h Hash) SRI() (string, error) {
+	for _, v := range sritypes {
+		if v == h.HashType {
+			return h.HashType + "-" + base64.StdEncoding.EncodeToString(h.Hash), nil
+		}
+	}
+	return "", ErrNoInterop
+}
+
+//Multihash serializes a hash as a binary multihash (varint code, varint length, digest)
+func (h Hash) Multihash() ([]byte, error) {
+	e, _, ok := hashreg.lookup(h.HashType)
+	if !ok || !e.hasmh {
+		return nil, ErrNoInterop
+	}
+	code := e.mhcode
+	buf := make([]byte, 2*binary.MaxVarintLen64+len(h.Hash))
+	n := binary.PutUvarint(buf, code)
+	n += binary.PutUvarint(buf[n:], uint64(len(h.Hash)))
+	n += copy(buf[n:], h.Hash)
+	return buf[:n], nil
+}
+
+//ParseMultihash parses a binary multihash
+//a multihash does not carry a content length, so it must be supplied
+func ParseMultihash(dat []byte, length uint64) (*Hash, error) {
+	code, n := binary.Uvarint(dat)
+	if n <= 0 {
+		return nil, ErrInvalid
+	}
+	dat = dat[n:]
+	l, n := binary.Uvarint(dat)
+	if n <= 0 || uint64(len(dat)-n) != l {
+		return nil, ErrInvalid
+	}
+	dat = dat[n:]
+	name, ok := multihashName(code)
+	if !ok {
+		return nil, ErrUnrecognizedHash
+	}
+	err := checkDigest(name, dat)
+	if err != nil {
+		return nil, err
+	}
+	return &Hash{
+		HashType: name,
+		Hash:     append([]byte(nil), dat...),
+		Len:      length,
+	}, nil
+}
+
+//multicodec code for raw binary content
+const cidRaw = 0x55
+
+//CID serializes a hash as a binary CIDv1 with the raw codec
+func (h Hash) CID() ([]byte, error) {
+	mh, err := h.Multihash()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 2*binary.MaxVarintLen64, 2*binary.MaxVarintLen64+len(mh))
+	n := binary.PutUvarint(buf, 1)
+	n += binary.PutUvarint(buf[n:], cidRaw)
+	return append(buf[:n], mh...), nil
+}
+
+//ParseCID parses a binary CIDv1 with the raw codec
+//a CID does not carry a content length, so it must be supplied
+func ParseCID(dat []byte, length uint64) (*Hash, error) {
+	ver, n := binary.Uvarint(dat)
+	if n <= 0 || ver != 1 {
+		return nil, ErrInvalid
+	}
+	dat = dat[n:]
+	codec, n := binary.Uvarint(dat)
+	if n <= 0 {
+		return nil, ErrInvalid
+	}
+	if codec != cidRaw {
+		return nil, ErrNoInterop
+	}
+	return ParseMultihash(dat[n:], length)
+}
@@ -0,0 +1,105 @@
+package dcdn
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"testing"
+)
+
+func TestSRI(t *testing.T) {
+	d := []byte("alert('Hello, world.');")
+	h := quickHash(t, d)
+	//round trip
+	sri, err := h.SRI()
+	if err != nil {
+		t.Fatalf("Failed to format SRI: %q\n", err.Error())
+	}
+	hval := sha256.Sum256(d)
+	if sri != "sha256-"+base64.StdEncoding.EncodeToString(hval[:]) {
+		t.Fatalf("Bad SRI formatting: %q\n", sri)
+	}
+	h2, err := ParseSRI(sri, h.Len)
+	if err != nil {
+		t.Fatalf("Failed to parse SRI: %q\n", err.Error())
+	}
+	if h2.String() != h.String() {
+		t.Fatalf("Inconsistency: %q => %q\n", h.String(), h2.String())
+	}
+	//strongest hash wins
+	h384 := sha512.Sum384(d)
+	h2, err = ParseSRI(sri+" sha384-"+base64.StdEncoding.EncodeToString(h384[:])+"?foo md5-abc", h.Len)
+	if err != nil {
+		t.Fatalf("Failed to parse SRI: %q\n", err.Error())
+	}
+	if h2.HashType != "sha384" {
+		t.Fatalf("Expected sha384 but got %q\n", h2.HashType)
+	}
+	//verify parsed hash
+	v, err := h2.Verifier()
+	if err != nil {
+		t.Fatalf("Failed to create sha384 verifier: %q\n", err.Error())
+	}
+	v.Write(d)
+	err = v.Verify()
+	if err != nil {
+		t.Fatalf("Unexpected verify error: %q\n", err.Error())
+	}
+	//errors
+	h2, err = ParseSRI("", 0)
+	testErr(t, h2, err, ErrInvalid)
+	h2, err = ParseSRI("md5-abc", 0)
+	testErr(t, h2, err, ErrUnrecognizedHash)
+	h2, err = ParseSRI("sha256-"+base64.StdEncoding.EncodeToString(hval[:16]), h.Len)
+	testErr(t, h2, err, ErrDigestLength)
+	h2, err = ParseSRI("sha384-"+base64.StdEncoding.EncodeToString(hval[:]), h.Len)
+	testErr(t, h2, err, ErrDigestLength)
+	_, err = Hash{HashType: "merkle-sha256"}.SRI()
+	if err != ErrNoInterop {
+		t.Fatalf("Expected no interop error but got %v\n", err)
+	}
+}
+
+func TestMultihash(t *testing.T) {
+	h := quickHash(t, []byte("multihash test"))
+	mh, err := h.Multihash()
+	if err != nil {
+		t.Fatalf("Failed to encode multihash: %q\n", err.Error())
+	}
+	if mh[0] != 0x12 || mh[1] != 32 || len(mh) != 34 {
+		t.Fatalf("Bad multihash encoding: %x\n", mh)
+	}
+	h2, err := ParseMultihash(mh, h.Len)
+	if err != nil {
+		t.Fatalf("Failed to parse multihash: %q\n", err.Error())
+	}
+	if h2.String() != h.String() {
+		t.Fatalf("Inconsistency: %q => %q\n", h.String(), h2.String())
+	}
+	//CID round trip
+	cid, err := h.CID()
+	if err != nil {
+		t.Fatalf("Failed to encode CID: %q\n", err.Error())
+	}
+	if cid[0] != 1 || cid[1] != 0x55 {
+		t.Fatalf("Bad CID encoding: %x\n", cid)
+	}
+	h2, err = ParseCID(cid, h.Len)
+	if err != nil {
+		t.Fatalf("Failed to parse CID: %q\n", err.Error())
+	}
+	if h2.String() != h.String() {
+		t.Fatalf("Inconsistency: %q => %q\n", h.String(), h2.String())
+	}
+	//errors
+	h2, err = ParseMultihash(mh[:10], h.Len)
+	testErr(t, h2, err, ErrInvalid)
+	h2, err = ParseMultihash([]byte{0x11, 1, 0}, 0)
+	testErr(t, h2, err, ErrUnrecognizedHash)
+	h2, err = ParseMultihash([]byte{0x12, 1, 0}, 0)
+	testErr(t, h2, err, ErrDigestLength)
+	h2, err = ParseMultihash(append([]byte{0x13, 32}, mh[2:]...), h.Len)
+	testErr(t, h2, err, ErrDigestLength)
+	h2, err = ParseCID([]byte{0}, 0)
+	testErr(t, h2, err, ErrInvalid)
+}
@@ -0,0 +1,122 @@
+package dcdn
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+//version of the binary hash encoding
+const hashBinVersion = 1
+
+//MarshalText implements encoding.TextMarshaler (same format as String)
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+//UnmarshalText implements encoding.TextUnmarshaler (same format as ParseHash)
+func (h *Hash) UnmarshalText(dat []byte) error {
+	v, err := ParseHash(string(dat))
+	if err != nil {
+		return err
+	}
+	*h = *v
+	return nil
+}
+
+//MarshalJSON implements json.Marshaler (encodes as a JSON string)
+func (h Hash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(h.String())
+}
+
+//UnmarshalJSON implements json.Unmarshaler
+func (h *Hash) UnmarshalJSON(dat []byte) error {
+	var str string
+	err := json.Unmarshal(dat, &str)
+	if err != nil {
+		return err
+	}
+	return h.UnmarshalText([]byte(str))
+}
+
+//MarshalBinary implements encoding.BinaryMarshaler
+//format: version byte, then varint-length-prefixed type and hash, then varint length
+func (h Hash) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 1, 1+3*binary.MaxVarintLen64+len(h.HashType)+len(h.Hash))
+	buf[0] = hashBinVersion
+	buf = appendUvarint(buf, uint64(len(h.HashType)))
+	buf = append(buf, h.HashType...)
+	buf = appendUvarint(buf, uint64(len(h.Hash)))
+	buf = append(buf, h.Hash...)
+	buf = appendUvarint(buf, h.Len)
+	return buf, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var vb [binary.MaxVarintLen64]byte
+	return append(buf, vb[:binary.PutUvarint(vb[:], v)]...)
+}
+
+//ErrUnsupportedVersion is an error returned when a binary hash uses an unknown encoding version
+var ErrUnsupportedVersion = errors.New("Unsupported binary hash version")
+
+//UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (h *Hash) UnmarshalBinary(dat []byte) error {
+	if len(dat) == 0 {
+		return ErrInvalid
+	}
+	if dat[0] != hashBinVersion {
+		return ErrUnsupportedVersion
+	}
+	dat = dat[1:]
+	//read a length-prefixed field
+	field := func() ([]byte, error) {
+		l, n := binary.Uvarint(dat)
+		if n <= 0 || uint64(len(dat)-n) < l {
+			return nil, ErrInvalid
+		}
+		f := dat[n : n+int(l)]
+		dat = dat[n+int(l):]
+		return f, nil
+	}
+	htype, err := field()
+	if err != nil {
+		return err
+	}
+	hdat, err := field()
+	if err != nil {
+		return err
+	}
+	l, n := binary.Uvarint(dat)
+	if n <= 0 || n != len(dat) {
+		return ErrInvalid
+	}
+	if hashFunc(string(htype)) == nil {
+		return ErrUnrecognizedHash
+	}
+	*h = Hash{
+		HashType: string(htype),
+		Hash:     append([]byte(nil), hdat...),
+		Len:      l,
+	}
+	return nil
+}
+
+//Value implements driver.Valuer (stored in text format)
+func (h Hash) Value() (driver.Value, error) {
+	return h.String(), nil
+}
+
+//Scan implements sql.Scanner (accepts the text format as a string or []byte)
+func (h *Hash) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case string:
+		return h.UnmarshalText([]byte(v))
+	case []byte:
+		return h.UnmarshalText(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a Hash", src)
+	}
+}
@@ -0,0 +1,106 @@
+package dcdn
+
+import (
+	"encoding/json"
+	"io"
+	"testing"
+)
+
+//genAll generates a hash of dat with every registered hash type
+func genAll(t *testing.T, dat []byte) []Hash {
+	var hashes []Hash
+	for _, ht := range HashTypes() {
+		name := ht.Name
+		h, err := GenHash(name, func(w io.Writer) (uint64, error) {
+			w.Write(dat)
+			return uint64(len(dat)), nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to generate %s hash: %q\n", name, err.Error())
+		}
+		hashes = append(hashes, *h)
+	}
+	return hashes
+}
+
+func TestMarshal(t *testing.T) {
+	for _, h := range genAll(t, []byte("marshalling test data")) {
+		h.Len = 1 << 40
+		//text
+		txt, err := h.MarshalText()
+		if err != nil {
+			t.Fatalf("Failed to marshal %s text: %q\n", h.HashType, err.Error())
+		}
+		var h2 Hash
+		err = h2.UnmarshalText(txt)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s text: %q\n", h.HashType, err.Error())
+		}
+		if h2.String() != h.String() {
+			t.Fatalf("Text inconsistency: %q => %q\n", h.String(), h2.String())
+		}
+		//json
+		js, err := json.Marshal(struct{ H Hash }{h})
+		if err != nil {
+			t.Fatalf("Failed to marshal %s JSON: %q\n", h.HashType, err.Error())
+		}
+		var j struct{ H Hash }
+		err = json.Unmarshal(js, &j)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s JSON: %q\n", h.HashType, err.Error())
+		}
+		if j.H.String() != h.String() {
+			t.Fatalf("JSON inconsistency: %q => %q\n", h.String(), j.H.String())
+		}
+		//binary
+		bin, err := h.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Failed to marshal %s binary: %q\n", h.HashType, err.Error())
+		}
+		var h3 Hash
+		err = h3.UnmarshalBinary(bin)
+		if err != nil {
+			t.Fatalf("Failed to unmarshal %s binary: %q\n", h.HashType, err.Error())
+		}
+		if h3.String() != h.String() {
+			t.Fatalf("Binary inconsistency: %q => %q\n", h.String(), h3.String())
+		}
+		//truncated binary
+		for i := 0; i < len(bin); i++ {
+			if h3.UnmarshalBinary(bin[:i]) == nil {
+				t.Fatalf("Truncated %s binary (%d/%d bytes) was accepted\n", h.HashType, i, len(bin))
+			}
+		}
+		//sql
+		v, err := h.Value()
+		if err != nil {
+			t.Fatalf("Failed to get %s SQL value: %q\n", h.HashType, err.Error())
+		}
+		var h4 Hash
+		err = h4.Scan(v)
+		if err != nil {
+			t.Fatalf("Failed to scan %s: %q\n", h.HashType, err.Error())
+		}
+		if h4.String() != h.String() {
+			t.Fatalf("SQL inconsistency: %q => %q\n", h.String(), h4.String())
+		}
+		err = h4.Scan([]byte(v.(string)))
+		if err != nil {
+			t.Fatalf("Failed to scan %s bytes: %q\n", h.HashType, err.Error())
+		}
+	}
+	//errors
+	var h Hash
+	if h.UnmarshalBinary([]byte{2}) != ErrUnsupportedVersion {
+		t.Fatal("Expected unsupported version error\n")
+	}
+	if h.UnmarshalBinary([]byte{1, 3, 'b', 'a', 'd', 0, 0}) != ErrUnrecognizedHash {
+		t.Fatal("Expected unrecognized hash error\n")
+	}
+	if h.Scan(42) == nil {
+		t.Fatal("Expected scan error\n")
+	}
+	if json.Unmarshal([]byte(`"x:y"`), &h) != ErrInvalid {
+		t.Fatal("Expected invalid hash error\n")
+	}
+}
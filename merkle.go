@@ -0,0 +1,270 @@
+package dcdn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+//parameters of a registered merkle hash type
+type merkleParams struct {
+	leaf      func() hash.Hash //hash function used for blocks and nodes
+	blocksize int              //size of a block in bytes
+}
+
+//RegisterMerkleHash registers a chunked hash type
+//the hash value is the root of a binary merkle tree over blocks of blocksize bytes
+func RegisterMerkleHash(name string, leaf func() hash.Hash, blocksize int) {
+	if blocksize < 1 {
+		panic(errors.New("merkle block size must be positive"))
+	}
+	p := merkleParams{
+		leaf:      leaf,
+		blocksize: blocksize,
+	}
+	hashreg.register(name, func() hash.Hash {
+		return newMerkleHash(p)
+	}, &p)
+}
+
+//add common merkle hash functions
+func init() {
+	RegisterMerkleHash("merkle-sha256", func() hash.Hash {
+		return sha256.New()
+	}, 64*1024)
+	SetHashStrength("merkle-sha256", 128)
+}
+
+//leafHash hashes a block (prefixed with 0 to distinguish it from a node)
+func (p merkleParams) leafHash(dat []byte) []byte {
+	h := p.leaf()
+	h.Write([]byte{0})
+	h.Write(dat)
+	return h.Sum(nil)
+}
+
+//nodeHash hashes two child nodes (prefixed with 1 to distinguish it from a leaf)
+func (p merkleParams) nodeHash(l, r []byte) []byte {
+	h := p.leaf()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+//root computes the merkle root over a list of block hashes
+//each level pairs up the nodes of the level below, and an odd node at the end is promoted
+func (p merkleParams) root(blocks [][]byte) []byte {
+	var f merkleFrontier
+	for _, b := range blocks {
+		f = f.push(p, b)
+	}
+	return f.root(p)
+}
+
+//merkleNode is the root of a complete subtree
+type merkleNode struct {
+	hash  []byte
+	level int //the subtree has 2^level blocks
+}
+
+//merkleFrontier is the list of complete subtrees over the blocks so far (largest first)
+//it has at most one subtree per level, so only O(log n) hashes are kept
+type merkleFrontier []merkleNode
+
+//push adds the hash of the next block
+func (f merkleFrontier) push(p merkleParams, blk []byte) merkleFrontier {
+	f = append(f, merkleNode{hash: blk})
+	for len(f) > 1 && f[len(f)-2].level == f[len(f)-1].level {
+		l, r := f[len(f)-2], f[len(f)-1]
+		f = append(f[:len(f)-2], merkleNode{hash: p.nodeHash(l.hash, r.hash), level: l.level + 1})
+	}
+	return f
+}
+
+//root computes the root hash without modifying the frontier
+//the incomplete subtrees on the right are promoted until they are paired with a larger one, so the smallest are combined first
+func (f merkleFrontier) root(p merkleParams) []byte {
+	if len(f) == 0 {
+		return p.leafHash(nil)
+	}
+	h := f[len(f)-1].hash
+	for i := len(f) - 2; i >= 0; i-- {
+		h = p.nodeHash(f[i].hash, h)
+	}
+	return h
+}
+
+//merkleHash is a hash.Hash which computes a merkle root
+type merkleHash struct {
+	p      merkleParams
+	buf    []byte         //partial block
+	tree   merkleFrontier //complete subtrees over completed blocks
+	keep   bool           //whether to keep the hashes of completed blocks (for a block list)
+	blocks [][]byte       //hashes of completed blocks (if keep is set)
+}
+
+func newMerkleHash(p merkleParams) *merkleHash {
+	return &merkleHash{
+		p:   p,
+		buf: make([]byte, 0, p.blocksize),
+	}
+}
+
+func (m *merkleHash) Write(dat []byte) (int, error) {
+	n := len(dat)
+	for len(dat) > 0 {
+		c := m.p.blocksize - len(m.buf)
+		if c > len(dat) {
+			c = len(dat)
+		}
+		m.buf = append(m.buf, dat[:c]...)
+		dat = dat[c:]
+		if len(m.buf) == m.p.blocksize {
+			blk := m.p.leafHash(m.buf)
+			m.tree = m.tree.push(m.p, blk)
+			if m.keep {
+				m.blocks = append(m.blocks, blk)
+			}
+			m.buf = m.buf[:0]
+		}
+	}
+	return n, nil
+}
+
+//blockList returns the block hashes including the trailing partial block (keep must be set)
+func (m *merkleHash) blockList() [][]byte {
+	blocks := m.blocks[:len(m.blocks):len(m.blocks)]
+	if len(m.buf) > 0 {
+		blocks = append(blocks, m.p.leafHash(m.buf))
+	}
+	return blocks
+}
+
+func (m *merkleHash) Sum(b []byte) []byte {
+	tree := m.tree
+	if len(m.buf) > 0 {
+		tree = tree[:len(tree):len(tree)].push(m.p, m.p.leafHash(m.buf)) //copied so that further writes are not affected
+	}
+	return append(b, tree.root(m.p)...)
+}
+
+func (m *merkleHash) Reset() {
+	m.buf = m.buf[:0]
+	m.tree = nil
+	m.blocks = nil
+}
+
+func (m *merkleHash) Size() int {
+	return m.p.leaf().Size()
+}
+
+func (m *merkleHash) BlockSize() int {
+	return m.p.blocksize
+}
+
+//ErrNoBlocks is an error returned when a hash type does not support block lists
+var ErrNoBlocks = errors.New("Hash type does not support block lists")
+
+//ErrBlockRange is an error returned when a block index is out of range
+var ErrBlockRange = errors.New("Block index out of range")
+
+//BlockList is a list of block hashes which make up a merkle hash
+type BlockList struct {
+	HashType  string   `json:"type"`
+	BlockSize int      `json:"blocksize"`
+	Blocks    [][]byte `json:"blocks"`
+}
+
+//GenBlockList reads data from r and generates a block list along with the root hash
+func GenBlockList(hashtype string, r io.Reader) (*BlockList, *Hash, error) {
+	p, ok := merkleParamsOf(hashtype)
+	if !ok {
+		if hashFunc(hashtype) == nil {
+			return nil, nil, ErrUnrecognizedHash
+		}
+		return nil, nil, ErrNoBlocks
+	}
+	m := newMerkleHash(p)
+	m.keep = true
+	n, err := io.Copy(m, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &BlockList{
+		HashType:  hashtype,
+		BlockSize: p.blocksize,
+		Blocks:    m.blockList(),
+	}, &Hash{
+		HashType: hashtype,
+		Hash:     m.Sum(nil),
+		Len:      uint64(n),
+	}, nil
+}
+
+//Check checks that the block list matches a hash
+func (bl *BlockList) Check(h Hash) error {
+	p, ok := merkleParamsOf(bl.HashType)
+	switch {
+	case !ok:
+		return ErrNoBlocks
+	case h.HashType != bl.HashType || p.blocksize != bl.BlockSize:
+		return ErrMismatch
+	}
+	nblk := (h.Len + uint64(p.blocksize) - 1) / uint64(p.blocksize)
+	switch {
+	case uint64(len(bl.Blocks)) < nblk:
+		return ErrTooShort
+	case uint64(len(bl.Blocks)) > nblk:
+		return ErrTooLong
+	case !bytes.Equal(p.root(bl.Blocks), h.Hash):
+		return ErrMismatch
+	default:
+		return nil
+	}
+}
+
+//BlockLen returns the length of block i of an object with a length of total bytes
+func (bl *BlockList) BlockLen(i int, total uint64) uint64 {
+	start := uint64(i) * uint64(bl.BlockSize)
+	if start >= total {
+		return 0
+	}
+	if total-start < uint64(bl.BlockSize) {
+		return total - start
+	}
+	return uint64(bl.BlockSize)
+}
+
+//BlockVerifier returns a Verifier for block i of an object with a length of total bytes
+//the block list should be checked against the object hash first
+func (bl *BlockList) BlockVerifier(i int, total uint64) (*Verifier, error) {
+	p, ok := merkleParamsOf(bl.HashType)
+	if !ok {
+		return nil, ErrNoBlocks
+	}
+	if i < 0 || i >= len(bl.Blocks) {
+		return nil, ErrBlockRange
+	}
+	v := new(Verifier)
+	v.h = p.leaf()
+	v.h.Write([]byte{0})
+	v.hd = bl.Blocks[i]
+	v.n = bl.BlockLen(i, total)
+	return v, nil
+}
+
+//VerifyBlock checks block i of an object with a length of total bytes
+func (bl *BlockList) VerifyBlock(i int, total uint64, dat []byte) error {
+	v, err := bl.BlockVerifier(i, total)
+	if err != nil {
+		return err
+	}
+	_, err = v.Write(dat)
+	if err != nil {
+		return err
+	}
+	return v.Verify()
+}
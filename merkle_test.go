@@ -0,0 +1,149 @@
+package dcdn
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+)
+
+func TestMerkle(t *testing.T) {
+	//generate data spanning several blocks with a partial trailing block
+	d := make([]byte, 3*64*1024+100)
+	for i := range d {
+		d[i] = byte(i*7 + i/1000)
+	}
+	bl, h, err := GenBlockList("merkle-sha256", bytes.NewReader(d))
+	if err != nil {
+		t.Fatalf("Failed to generate block list: %q\n", err.Error())
+	}
+	if len(bl.Blocks) != 4 {
+		t.Fatalf("Expected 4 blocks but got %d\n", len(bl.Blocks))
+	}
+	//root must match the streaming hash
+	h2, err := GenHash("merkle-sha256", func(w io.Writer) (uint64, error) {
+		w.Write(d)
+		return uint64(len(d)), nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to generate merkle hash: %q\n", err.Error())
+	}
+	if h.String() != h2.String() {
+		t.Fatalf("Inconsistency: %q != %q\n", h.String(), h2.String())
+	}
+	//the root should verify with a normal verifier
+	v, err := h.Verifier()
+	if err != nil {
+		t.Fatalf("Failed to create merkle verifier: %q\n", err.Error())
+	}
+	v.Write(d)
+	err = v.Verify()
+	if err != nil {
+		t.Fatalf("Unexpected verify error: %q\n", err.Error())
+	}
+	//check the block list
+	err = bl.Check(*h)
+	if err != nil {
+		t.Fatalf("Block list check failed: %q\n", err.Error())
+	}
+	//verify each block
+	for i := range bl.Blocks {
+		end := (i + 1) * bl.BlockSize
+		if end > len(d) {
+			end = len(d)
+		}
+		err = bl.VerifyBlock(i, h.Len, d[i*bl.BlockSize:end])
+		if err != nil {
+			t.Fatalf("Block %d failed verification: %q\n", i, err.Error())
+		}
+	}
+	//corrupt block
+	bad := append([]byte(nil), d[:bl.BlockSize]...)
+	bad[5]++
+	err = bl.VerifyBlock(0, h.Len, bad)
+	if err != ErrMismatch {
+		t.Fatalf("Expected hash mismatch but got %v\n", err)
+	}
+	//tampered block list
+	bl.Blocks[1] = bl.Blocks[2]
+	err = bl.Check(*h)
+	if err != ErrMismatch {
+		t.Fatalf("Expected hash mismatch but got %v\n", err)
+	}
+	bl.Blocks = bl.Blocks[:3]
+	err = bl.Check(*h)
+	if err != ErrTooShort {
+		t.Fatalf("Expected too short error but got %v\n", err)
+	}
+	//non-merkle hash
+	_, _, err = GenBlockList("sha256", bytes.NewReader(d))
+	if err != ErrNoBlocks {
+		t.Fatalf("Expected no blocks error but got %v\n", err)
+	}
+	//empty input
+	bl, h, err = GenBlockList("merkle-sha256", bytes.NewReader(nil))
+	if err != nil {
+		t.Fatalf("Failed to generate empty block list: %q\n", err.Error())
+	}
+	err = bl.Check(*h)
+	if err != nil {
+		t.Fatalf("Empty block list check failed: %q\n", err.Error())
+	}
+}
+
+//leafHashes hashes the blocks of d
+func leafHashes(p merkleParams, d []byte) [][]byte {
+	var blocks [][]byte
+	for i := 0; i < len(d); i += p.blocksize {
+		end := i + p.blocksize
+		if end > len(d) {
+			end = len(d)
+		}
+		blocks = append(blocks, p.leafHash(d[i:end]))
+	}
+	return blocks
+}
+
+//levelRoot computes a merkle root level by level (promoting odd nodes)
+func levelRoot(p merkleParams, blocks [][]byte) []byte {
+	if len(blocks) == 0 {
+		return p.leafHash(nil)
+	}
+	lvl := blocks
+	for len(lvl) > 1 {
+		var nxt [][]byte
+		for i := 0; i < len(lvl); i += 2 {
+			if i+1 == len(lvl) {
+				nxt = append(nxt, lvl[i])
+				continue
+			}
+			nxt = append(nxt, p.nodeHash(lvl[i], lvl[i+1]))
+		}
+		lvl = nxt
+	}
+	return lvl[0]
+}
+
+func TestMerkleFrontier(t *testing.T) {
+	p := merkleParams{leaf: sha256.New, blocksize: 4}
+	d := make([]byte, 40*p.blocksize)
+	for i := range d {
+		d[i] = byte(i)
+	}
+	full := levelRoot(p, leafHashes(p, d))
+	for n := 0; n <= len(d); n += 3 {
+		m := newMerkleHash(p)
+		m.Write(d[:n])
+		if !bytes.Equal(m.Sum(nil), levelRoot(p, leafHashes(p, d[:n]))) {
+			t.Fatalf("[%d bytes] Frontier root does not match the tree\n", n)
+		}
+		if len(m.tree) > 6 {
+			t.Fatalf("[%d bytes] Frontier has %d nodes\n", n, len(m.tree))
+		}
+		//summing does not affect further writes
+		m.Write(d[n:])
+		if !bytes.Equal(m.Sum(nil), full) {
+			t.Fatalf("[%d bytes] Root changed by an earlier Sum\n", n)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package dcdn
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//ErrForbiddenPath is an error returned when a path is rejected by the path policy
+var ErrForbiddenPath = errors.New("Path forbidden by policy")
+
+//SymlinkPolicy selects how symlinks in the content directory are handled
+type SymlinkPolicy int
+
+//symlink policies
+const (
+	SymlinkWithinRoot SymlinkPolicy = iota //follow symlinks which resolve to a path inside the content directory
+	SymlinkFollow                          //follow all symlinks
+	SymlinkDeny                            //reject any path which contains a symlink
+)
+
+func (p SymlinkPolicy) String() string {
+	switch p {
+	case SymlinkWithinRoot:
+		return "within-root"
+	case SymlinkFollow:
+		return "follow"
+	case SymlinkDeny:
+		return "deny"
+	default:
+		return "unknown"
+	}
+}
+
+//PathPolicy restricts which paths a HashCache will hash and open
+//the zero value only allows regular files without hidden path elements and symlinks leaving the content directory
+type PathPolicy struct {
+	Symlinks        SymlinkPolicy //how symlinks are handled (only applies to directory content)
+	AllowHidden     bool          //allow paths with elements starting with a dot
+	AllowNonRegular bool          //allow directories, FIFOs, devices and other non-regular files
+}
+
+//hidden checks whether an fs.FS name has a hidden element
+func hidden(name string) bool {
+	if name == "." {
+		return false
+	}
+	for _, el := range strings.Split(name, "/") {
+		if strings.HasPrefix(el, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+//within checks whether a path is inside a directory (both must be absolute and free of symlinks)
+func within(dir string, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+//stat checks a path against the path policy and stats it
+func (hc *HashCache) stat(p string) (fs.FileInfo, error) {
+	pol := hc.opts.Paths
+	name := fsName(p)
+	if !pol.AllowHidden && hidden(name) {
+		return nil, ErrForbiddenPath
+	}
+	var checked fs.FileInfo //the file which passed the symlink checks
+	if hc.dir != "" && pol.Symlinks != SymlinkFollow && name != "." {
+		fpath := hc.dir
+		link := false
+		for _, el := range strings.Split(name, "/") {
+			fpath = filepath.Join(fpath, el)
+			inf, err := os.Lstat(fpath)
+			if err != nil {
+				return nil, err
+			}
+			if inf.Mode()&os.ModeSymlink != 0 {
+				if pol.Symlinks == SymlinkDeny {
+					return nil, ErrForbiddenPath
+				}
+				link = true
+				break
+			}
+			checked = inf
+		}
+		if link {
+			real, err := filepath.EvalSymlinks(filepath.Join(hc.dir, filepath.FromSlash(name)))
+			if err != nil {
+				return nil, err
+			}
+			real, err = filepath.Abs(real)
+			if err != nil {
+				return nil, err
+			}
+			if !within(hc.root, real) {
+				return nil, ErrForbiddenPath
+			}
+			checked, err = os.Stat(real)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	inf := checked
+	if inf == nil {
+		var err error
+		inf, err = fs.Stat(hc.fsys, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !inf.Mode().IsRegular() && !pol.AllowNonRegular {
+		return nil, ErrForbiddenPath
+	}
+	return inf, nil
+}
+
+//open checks a path against the path policy and opens it
+//the opened file must be the one which was checked, so that the path can not be swapped for a symlink in between
+func (hc *HashCache) open(p string) (fs.File, fs.FileInfo, error) {
+	checked, err := hc.stat(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := hc.fsys.Open(fsName(p))
+	if err != nil {
+		return nil, nil, err
+	}
+	inf, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if (hc.dir != "" && !os.SameFile(checked, inf)) || (!inf.Mode().IsRegular() && !hc.opts.Paths.AllowNonRegular) {
+		//the file was replaced after the check
+		f.Close()
+		return nil, nil, ErrForbiddenPath
+	}
+	return f, inf, nil
+}
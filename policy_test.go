@@ -0,0 +1,195 @@
+package dcdn
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPathPolicy(t *testing.T) {
+	base, err := ioutil.TempDir("", "dcdnpolicy")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(base)
+	root := filepath.Join(base, "root")
+	for _, d := range []string{"sub", ".git"} {
+		os.MkdirAll(filepath.Join(root, d), 0700)
+	}
+	for _, f := range []string{"file", "sub/file", ".hidden", ".git/config"} {
+		ioutil.WriteFile(filepath.Join(root, filepath.FromSlash(f)), []byte(f), 0600)
+	}
+	ioutil.WriteFile(filepath.Join(base, "secret"), []byte("secret"), 0600)
+	links := true
+	for l, target := range map[string]string{
+		"in":     "file",
+		"indir":  "sub",
+		"out":    filepath.Join("..", "secret"),
+		"outdir": "..",
+	} {
+		if os.Symlink(target, filepath.Join(root, l)) != nil {
+			links = false
+		}
+	}
+	const (
+		ok = iota
+		forbidden
+		notexist
+	)
+	tbl := []struct {
+		path   string
+		policy PathPolicy
+		expect int
+	}{
+		{"/file", PathPolicy{}, ok},
+		{"/sub/file", PathPolicy{}, ok},
+		{"/sub/../file", PathPolicy{}, ok},
+		{"/../secret", PathPolicy{}, notexist},
+		{"/../../secret", PathPolicy{Symlinks: SymlinkFollow}, notexist},
+		{"/sub/../../secret", PathPolicy{}, notexist},
+		{"/..\\secret", PathPolicy{}, forbidden},
+		{"/.hidden", PathPolicy{}, forbidden},
+		{"/.git/config", PathPolicy{}, forbidden},
+		{"/.hidden", PathPolicy{AllowHidden: true}, ok},
+		{"/.git/config", PathPolicy{AllowHidden: true}, ok},
+		{"/sub", PathPolicy{}, forbidden},
+		{"/", PathPolicy{}, forbidden},
+		{"/missing", PathPolicy{}, notexist},
+	}
+	if links {
+		tbl = append(tbl, []struct {
+			path   string
+			policy PathPolicy
+			expect int
+		}{
+			{"/in", PathPolicy{}, ok},
+			{"/indir/file", PathPolicy{}, ok},
+			{"/out", PathPolicy{}, forbidden},
+			{"/outdir/secret", PathPolicy{}, forbidden},
+			{"/outdir/root/file", PathPolicy{}, ok},
+			{"/in", PathPolicy{Symlinks: SymlinkDeny}, forbidden},
+			{"/indir/file", PathPolicy{Symlinks: SymlinkDeny}, forbidden},
+			{"/out", PathPolicy{Symlinks: SymlinkFollow}, ok},
+			{"/outdir/secret", PathPolicy{Symlinks: SymlinkFollow}, ok},
+		}...)
+	} else {
+		t.Log("Symlinks not supported, skipping symlink tests")
+	}
+	for _, v := range tbl {
+		hc, err := NewHashCacheWithOptions(root, HashCacheOptions{Paths: v.policy})
+		if err != nil {
+			t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+		}
+		f, _, _, err := hc.Get(v.path)
+		if err == nil {
+			f.Close()
+		}
+		var got int
+		switch {
+		case err == nil:
+			got = ok
+		case err == ErrForbiddenPath:
+			got = forbidden
+		case os.IsNotExist(err):
+			got = notexist
+		default:
+			t.Errorf("Unexpected error for %q: %q\n", v.path, err.Error())
+			hc.Close()
+			continue
+		}
+		if got != v.expect {
+			t.Errorf("Unexpected result for %q with %+v: got %d expected %d (%v)\n", v.path, v.policy, got, v.expect, err)
+		}
+		//hashing must also enforce the policy
+		if _, _, err := hc.GetChunks(v.path); (err == nil) != (v.expect == ok) {
+			t.Errorf("Unexpected chunk result for %q with %+v: %v\n", v.path, v.policy, err)
+		}
+		hc.Close()
+	}
+}
+
+func TestFileServerTraversal(t *testing.T) {
+	base, err := ioutil.TempDir("", "dcdntraversal")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(base)
+	root := filepath.Join(base, "root")
+	os.Mkdir(root, 0700)
+	ioutil.WriteFile(filepath.Join(root, ".env"), []byte("env"), 0600)
+	ioutil.WriteFile(filepath.Join(base, "secret"), []byte("secret"), 0600)
+	hc, err := NewHashCache(root)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	fs := FileServer{HashCache: hc, ErrLogger: func(error) {}}
+	tbl := map[string]int{
+		"/../secret":       http.StatusNotFound,
+		"/./../../secret":  http.StatusNotFound,
+		"/.env":            http.StatusForbidden,
+		"/%2e%2e/secret":   http.StatusNotFound,
+		"/..%2fsecret":     http.StatusNotFound,
+		"/%2e%2e%2fsecret": http.StatusNotFound,
+	}
+	for p, code := range tbl {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com"+p, nil)
+		w := httptest.NewRecorder()
+		fs.ServeHTTP(w, r)
+		if w.Code != code {
+			t.Errorf("Unexpected status for %q: %d (expected %d)\n", p, w.Code, code)
+		}
+	}
+}
+
+//swapFS is an fs.FS which calls swap before opening a file (but not before a stat)
+type swapFS struct {
+	fs.FS
+	swap func()
+}
+
+func (s swapFS) Open(name string) (fs.File, error) {
+	s.swap()
+	return s.FS.Open(name)
+}
+
+func (s swapFS) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(s.FS, name)
+}
+
+func TestPathPolicySwap(t *testing.T) {
+	base, err := ioutil.TempDir("", "dcdnswap")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(base)
+	root := filepath.Join(base, "root")
+	os.MkdirAll(root, 0700)
+	ioutil.WriteFile(filepath.Join(base, "secret"), []byte("secret"), 0600)
+	ioutil.WriteFile(filepath.Join(root, "file"), []byte("file"), 0600)
+	if os.Symlink(filepath.Join(base, "secret"), filepath.Join(root, "link")) != nil {
+		t.Skip("Symlinks not supported")
+	}
+	hc, err := NewHashCache(root)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	//the file is swapped for a symlink out of the root after it was checked
+	hc.fsys = swapFS{hc.fsys, func() {
+		os.Rename(filepath.Join(root, "link"), filepath.Join(root, "file"))
+	}}
+	f, _, err := hc.open("/file")
+	if err == nil {
+		dat, _ := ioutil.ReadAll(f)
+		f.Close()
+		t.Fatalf("File swapped after the check opened: %q\n", dat)
+	}
+	if err != ErrForbiddenPath {
+		t.Fatalf("Expected forbidden path error but got %v\n", err)
+	}
+}
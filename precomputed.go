@@ -0,0 +1,178 @@
+package dcdn
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io/fs"
+	"math/rand"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//PrecomputedSource is a set of sources of precomputed hashes which a HashCache may trust instead of reading the file
+type PrecomputedSource int
+
+//precomputed hash sources
+const (
+	PrecomputedSidecar  PrecomputedSource = 1 << iota //sidecar files next to the file (e.g. foo.tar.gz.sha256)
+	PrecomputedManifest                               //checksum manifests in the directory of the file or a parent (e.g. SHA256SUMS)
+	PrecomputedXattr                                  //extended attributes of the file (e.g. user.dcdn.sha256, directory content only)
+)
+
+//sidecar files and manifests are only trusted if they are at least as new as the file
+//extended attributes have no modification time, so they must be removed or updated whenever the file changes
+
+//parseSum decodes a hex hash (nil if invalid for the hash type)
+func parseSum(hashtype string, str string) []byte {
+	hf := hashFunc(hashtype)
+	if hf == nil {
+		return nil
+	}
+	sum, err := hex.DecodeString(str)
+	if err != nil || len(sum) != hf().Size() {
+		return nil
+	}
+	return sum
+}
+
+//parseSumLine parses a line of a checksum manifest in GNU ("<hex>  <name>" or "<hex> *<name>") or BSD ("SHA256 (<name>) = <hex>") format
+func parseSumLine(line string) (sum string, name string, ok bool) {
+	line = strings.TrimRight(line, "\r")
+	if i := strings.Index(line, " ("); i > 0 && !strings.HasPrefix(line, "#") {
+		if j := strings.LastIndex(line, ") = "); j > i {
+			return line[j+4:], line[i+2 : j], true
+		}
+	}
+	i := strings.IndexByte(line, ' ')
+	if i <= 0 || i+2 > len(line) {
+		return "", "", false
+	}
+	name = line[i+1:]
+	if name[0] == ' ' || name[0] == '*' {
+		name = name[1:]
+	}
+	return line[:i], name, true
+}
+
+//checksum manifest
+type manifest struct {
+	mtime time.Time
+	sums  map[string]string //file name (relative to the manifest directory) -> hex hash
+}
+
+//manifestCache caches parsed checksum manifests
+type manifestCache struct {
+	lck  sync.Mutex
+	ents map[string]*manifest
+}
+
+//load gets a parsed manifest (reloading it if it changed)
+func (mc *manifestCache) load(fsys fs.FS, name string) *manifest {
+	inf, err := fs.Stat(fsys, name)
+	if err != nil || !inf.Mode().IsRegular() {
+		return nil
+	}
+	mc.lck.Lock()
+	m := mc.ents[name]
+	mc.lck.Unlock()
+	if m != nil && m.mtime.Equal(inf.ModTime()) {
+		return m
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	m = &manifest{
+		mtime: inf.ModTime(),
+		sums:  make(map[string]string),
+	}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if sum, fname, ok := parseSumLine(s.Text()); ok {
+			m.sums[path.Clean(fname)] = sum
+		}
+	}
+	if s.Err() != nil {
+		return nil
+	}
+	mc.lck.Lock()
+	defer mc.lck.Unlock()
+	if mc.ents == nil {
+		mc.ents = make(map[string]*manifest)
+	}
+	mc.ents[name] = m
+	return m
+}
+
+//lookup searches for a file in the manifests of its directory and all parent directories
+func (mc *manifestCache) lookup(fsys fs.FS, file string, inf fs.FileInfo, hashtype string) string {
+	mname := strings.ToUpper(hashtype) + "SUMS"
+	dir, rel := path.Split(fsName(file))
+	for {
+		m := mc.load(fsys, path.Join(dir, mname))
+		if m != nil && !m.mtime.Before(inf.ModTime()) {
+			if sum, ok := m.sums[rel]; ok {
+				return sum
+			}
+		}
+		if dir == "" {
+			return ""
+		}
+		d, base := path.Split(strings.TrimSuffix(dir, "/"))
+		dir, rel = d, path.Join(base, rel)
+	}
+}
+
+//sidecarHash reads the hash of a file from a sidecar file
+func (hc *HashCache) sidecarHash(file string, inf fs.FileInfo, hashtype string) string {
+	name := fsName(file) + "." + hashtype
+	sinf, err := fs.Stat(hc.fsys, name)
+	if err != nil || sinf.ModTime().Before(inf.ModTime()) || sinf.Size() > 4096 {
+		return ""
+	}
+	dat, err := fs.ReadFile(hc.fsys, name)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(dat))
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
+//precomputed looks up precomputed hashes of a file (nil unless there is one for every hash type)
+func (hc *HashCache) precomputed(file string, inf fs.FileInfo, hashtypes []string) []*Hash {
+	src := hc.opts.Precomputed
+	hashes := make([]*Hash, len(hashtypes))
+	for i, t := range hashtypes {
+		var sum []byte
+		if src&PrecomputedSidecar != 0 {
+			sum = parseSum(t, hc.sidecarHash(file, inf, t))
+		}
+		if sum == nil && src&PrecomputedManifest != 0 {
+			sum = parseSum(t, hc.manifests.lookup(hc.fsys, file, inf, t))
+		}
+		if sum == nil && src&PrecomputedXattr != 0 && hc.dir != "" {
+			sum = parseSum(t, strings.TrimSpace(readXattr(filepath.Join(hc.dir, filepath.FromSlash(fsName(file))), "user.dcdn."+t)))
+		}
+		if sum == nil {
+			return nil
+		}
+		hashes[i] = &Hash{
+			HashType: t,
+			Hash:     sum,
+			Len:      uint64(inf.Size()),
+		}
+	}
+	return hashes
+}
+
+//spotCheck decides whether precomputed hashes should be verified against the content
+func (hc *HashCache) spotCheck() bool {
+	return hc.opts.VerifyRate > 0 && rand.Float64() < hc.opts.VerifyRate
+}
@@ -0,0 +1,116 @@
+package dcdn
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSumLine(t *testing.T) {
+	tbl := []struct {
+		line string
+		sum  string
+		name string
+		ok   bool
+	}{
+		{"abcd  foo.tar.gz", "abcd", "foo.tar.gz", true},
+		{"abcd *dir/foo bar", "abcd", "dir/foo bar", true},
+		{"SHA256 (foo (1).txt) = abcd", "abcd", "foo (1).txt", true},
+		{"abcd foo\r", "abcd", "foo", true},
+		{"abcd", "", "", false},
+		{"", "", "", false},
+	}
+	for _, v := range tbl {
+		sum, name, ok := parseSumLine(v.line)
+		if sum != v.sum || name != v.name || ok != v.ok {
+			t.Errorf("parseSumLine(%q) = %q, %q, %v\n", v.line, sum, name, ok)
+		}
+	}
+}
+
+func TestPrecomputedHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnpre")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fake := quickHash(t, []byte("something else"))
+	fakehex := hex.EncodeToString(fake.Hash)
+	write := func(name string, dat string) {
+		fpath := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(fpath), 0700)
+		err := ioutil.WriteFile(fpath, []byte(dat), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write %q: %q\n", name, err.Error())
+		}
+	}
+	write("side", "sidecar content")
+	write("side.sha256", fakehex+"  side\n")
+	write("sub/man", "manifest content")
+	write("sub/bsd", "bsd content")
+	write("SHA256SUMS", fakehex+"  sub/man\nSHA256 (sub/bsd) = "+fakehex+"\n")
+	write("stale", "stale content")
+	write("stale.sha256", fakehex)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, "stale.sha256"), old, old)
+	write("plain", "plain content")
+	get := func(hc *HashCache, p string) string {
+		f, h, _, err := hc.Get(p)
+		if err != nil {
+			t.Fatalf("Failed to get %q: %q\n", p, err.Error())
+		}
+		f.Close()
+		return h.String()
+	}
+	hc, err := NewHashCacheWithOptions(dir, HashCacheOptions{Precomputed: PrecomputedSidecar | PrecomputedManifest})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	tbl := []struct {
+		path    string
+		content string
+		trusted bool
+	}{
+		{"/side", "sidecar content", true},
+		{"/sub/man", "manifest content", true},
+		{"/sub/bsd", "bsd content", true},
+		{"/stale", "stale content", false},
+		{"/plain", "plain content", false},
+	}
+	for _, v := range tbl {
+		expect := quickHash(t, []byte(v.content))
+		if v.trusted {
+			expect.Hash = fake.Hash
+		}
+		if h := get(hc, v.path); h != expect.String() {
+			t.Errorf("Unexpected hash of %q: %q\n", v.path, h)
+		}
+	}
+	hc.Close()
+	//spot checks detect bad precomputed hashes
+	var logged []error
+	hc, err = NewHashCacheWithOptions(dir, HashCacheOptions{
+		Precomputed: PrecomputedSidecar | PrecomputedManifest,
+		VerifyRate:  1,
+		ErrLogger:   func(err error) { logged = append(logged, err) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	for _, v := range tbl {
+		if h := get(hc, v.path); h != quickHash(t, []byte(v.content)).String() {
+			t.Errorf("Unexpected hash of %q with verification: %q\n", v.path, h)
+		}
+	}
+	if st := hc.Stats(); st.Mismatches != 3 {
+		t.Fatalf("Expected 3 mismatches but got %d\n", st.Mismatches)
+	}
+	if len(logged) != 3 || !errors.Is(logged[0], ErrMismatch) {
+		t.Fatalf("Expected 3 logged mismatches but got %v\n", logged)
+	}
+}
@@ -0,0 +1,91 @@
+package dcdn
+
+import (
+	"net/http"
+	"net/url"
+	"sync/atomic"
+)
+
+//RedirectPolicy decides when a FileServer sends clients to a cache instead of sending files itself
+type RedirectPolicy interface {
+	//Redirect is called before a file with a hash of h is sent, and returns whether to redirect the client
+	//if the file is sent, done is called once it has been sent (done may be nil)
+	Redirect(r *http.Request, h Hash) (redirect bool, done func())
+}
+
+//RedirectAlways redirects every request
+type RedirectAlways struct{}
+
+//Redirect implements RedirectPolicy
+func (RedirectAlways) Redirect(*http.Request, Hash) (bool, func()) {
+	return true, nil
+}
+
+//RedirectSize redirects requests for files of at least this many bytes
+type RedirectSize uint64
+
+//Redirect implements RedirectPolicy
+func (rs RedirectSize) Redirect(r *http.Request, h Hash) (bool, func()) {
+	return h.Len >= uint64(rs), nil
+}
+
+//RedirectConcurrency redirects requests while Max files are already being sent
+//it must be used by pointer, so that all copies of a FileServer share the count
+type RedirectConcurrency struct {
+	Max    int64
+	active int64 //number of files being sent
+}
+
+//Redirect implements RedirectPolicy
+func (rc *RedirectConcurrency) Redirect(r *http.Request, h Hash) (bool, func()) {
+	if atomic.AddInt64(&rc.active, 1) > rc.Max {
+		atomic.AddInt64(&rc.active, -1)
+		return true, nil
+	}
+	return false, func() {
+		atomic.AddInt64(&rc.active, -1)
+	}
+}
+
+//cacheURL builds the URL of a request to a cache server
+func cacheURL(s *url.URL, query url.Values) *url.URL {
+	su := new(url.URL)
+	*su = *s
+	q := su.Query()
+	for k, v := range query {
+		q[k] = v
+	}
+	su.RawQuery = q.Encode()
+	return su
+}
+
+//sendToCache redirects the client to a cache (with a 307 response)
+//the X-DCDN-HASH headers must already be set, and all selected caches are listed in X-DCDN-Cache headers so that the client can fall back
+//returns false if there are no caches
+func (fs FileServer) sendToCache(w http.ResponseWriter, r *http.Request, h *Hash) bool {
+	srvs := fs.Caches.SelectServers()
+	if len(srvs) == 0 {
+		return false
+	}
+	query := url.Values{
+		"hash": {h.String()},
+		"url":  {requestURL(r).String()},
+	}
+	hdr := w.Header()
+	if enc := hdr.Get("Content-Encoding"); enc != "" {
+		//the redirect itself is not encoded
+		query.Set("encoding", enc)
+		hdr.Set("X-DCDN-Encoding", enc)
+		hdr.Del("Content-Encoding")
+	}
+	for _, s := range srvs {
+		hdr.Add("X-DCDN-Cache", s.String())
+	}
+	hdr.Set("Location", cacheURL(srvs[0], query).String())
+	hdr.Del("Etag")
+	hdr.Del("Content-Type")
+	hdr.Set("Cache-Control", "no-store") //the decision only applies to this request
+	hdr.Set("Content-Length", "0")
+	w.WriteHeader(http.StatusTemporaryRedirect)
+	return true
+}
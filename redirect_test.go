@@ -0,0 +1,185 @@
+package dcdn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+//reportingSelector is a StaticSelector which records the servers reported as failed
+type reportingSelector struct {
+	StaticSelector
+	lck    sync.Mutex
+	failed []*url.URL
+}
+
+func (s *reportingSelector) ReportFailure(u *url.URL) {
+	s.lck.Lock()
+	defer s.lck.Unlock()
+	s.failed = append(s.failed, u)
+}
+
+func TestRedirectConcurrency(t *testing.T) {
+	rc := &RedirectConcurrency{Max: 1}
+	redirect, done := rc.Redirect(nil, Hash{})
+	if redirect || done == nil {
+		t.Fatalf("First request redirected\n")
+	}
+	if redirect, _ := rc.Redirect(nil, Hash{}); !redirect {
+		t.Fatalf("Request over the limit not redirected\n")
+	}
+	done()
+	redirect, done = rc.Redirect(nil, Hash{})
+	if redirect {
+		t.Fatalf("Request redirected after the limit was freed\n")
+	}
+	done()
+}
+
+func TestRedirect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnredir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	big := bytes.Repeat([]byte("big file "), 100)
+	ioutil.WriteFile(filepath.Join(dir, "big"), big, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "small"), []byte("small"), 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	bigHash := quickHash(t, big)
+	//a cache which does not work, and a cache which serves the big file
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+	var cacheDown int32
+	var cacheHits int32
+	cache := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&cacheDown) != 0 || r.URL.Query().Get("hash") != bigHash.String() {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&cacheHits, 1)
+		w.Header().Set("X-DCDN", "cache")
+		w.Header().Set("X-DCDN-HASH", bigHash.String())
+		w.Write(big)
+	}))
+	defer cache.Close()
+	bu, _ := url.Parse(broken.URL)
+	cu, _ := url.Parse(cache.URL)
+	srv := httptest.NewServer(FileServer{
+		HashCache: hc,
+		ErrLogger: func(error) {},
+		Redirect:  RedirectSize(100),
+		Caches:    StaticSelector{bu, cu},
+	})
+	defer srv.Close()
+	//the redirect response
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/big?v=1&x=a+b", nil)
+	resp, err := noFollow.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("X-DCDN-HASH") != bigHash.String() {
+		t.Fatalf("Bad redirect response: %s %v\n", resp.Status, resp.Header)
+	}
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(loc.String(), broken.URL) || loc.Query().Get("hash") != bigHash.String() || loc.Query().Get("url") != srv.URL+"/big?v=1&x=a+b" {
+		t.Fatalf("Bad redirect location: %q\n", resp.Header.Get("Location"))
+	}
+	if len(resp.Header.Values("X-DCDN-Cache")) != 2 || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("Bad redirect headers: %v\n", resp.Header)
+	}
+	//small files, HEAD requests and requests which opt out are not redirected
+	for _, v := range []struct {
+		method, path string
+		hdr          string
+	}{
+		{http.MethodGet, "/small", ""},
+		{http.MethodHead, "/big", ""},
+		{http.MethodGet, "/big", "X-DCDN-NOREDIRECT"},
+	} {
+		req, _ := http.NewRequest(v.method, srv.URL+v.path, nil)
+		if v.hdr != "" {
+			req.Header.Set(v.hdr, "true")
+		}
+		resp, err := noFollow.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %q\n", err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("[%s %s %s] Expected no redirect but got %s\n", v.method, v.path, v.hdr, resp.Status)
+		}
+	}
+	//the client tries the recommended caches
+	su, _ := url.Parse(srv.URL + "/big")
+	cli := NewClient()
+	defer cli.Close()
+	get := func() *http.Response {
+		resp, h, err := cli.Get(su)
+		if err != nil {
+			t.Fatalf("Client request failed: %q\n", err.Error())
+		}
+		defer resp.Body.Close()
+		dat, err := ioutil.ReadAll(resp.Body)
+		if err != nil || !bytes.Equal(dat, big) || h == nil || h.String() != bigHash.String() {
+			t.Fatalf("Bad client response: %v %v\n", err, h)
+		}
+		return resp
+	}
+	if resp := get(); resp.Header.Get("X-DCDN") != "cache" || atomic.LoadInt32(&cacheHits) != 1 {
+		t.Fatalf("Content not loaded from the cache: %v\n", resp.Header)
+	}
+	//and falls back to the origin if none of them work
+	atomic.StoreInt32(&cacheDown, 1)
+	if resp := get(); resp.Header.Get("X-DCDN") != "server" {
+		t.Fatalf("Content not loaded from the origin: %v\n", resp.Header)
+	}
+	//only failures of the caches picked by the selector are reported to it
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	du, _ := url.Parse(down.URL)
+	rs := &reportingSelector{StaticSelector: StaticSelector{du}}
+	cli.SetSelector(rs)
+	if resp := get(); resp.Header.Get("X-DCDN") != "server" {
+		t.Fatalf("Content not loaded from the origin: %v\n", resp.Header)
+	}
+	if len(rs.failed) != 1 || rs.failed[0] != du {
+		t.Fatalf("Expected only the selected cache to be reported but got %v\n", rs.failed)
+	}
+	//plain HTTP clients follow the redirect
+	atomic.StoreInt32(&cacheDown, 0)
+	srv2 := httptest.NewServer(FileServer{
+		HashCache: hc,
+		ErrLogger: func(error) {},
+		Redirect:  RedirectAlways{},
+		Caches:    StaticSelector{cu},
+	})
+	defer srv2.Close()
+	resp, err = http.Get(srv2.URL + "/big")
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	dat, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Equal(dat, big) || resp.Header.Get("X-DCDN") != "cache" {
+		t.Fatalf("Redirect not followed: %v\n", resp.Header)
+	}
+}
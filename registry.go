@@ -0,0 +1,295 @@
+package dcdn
+
+import (
+	"errors"
+	"hash"
+	"sort"
+	"sync"
+)
+
+//HashStatus is the security status of a hash function
+type HashStatus int
+
+//hash function statuses
+const (
+	HashOK         HashStatus = iota //hash function is fine to use
+	HashDeprecated                   //hash function works but should be migrated away from
+	HashInsecure                     //hash function is broken and must not be trusted
+)
+
+func (s HashStatus) String() string {
+	switch s {
+	case HashOK:
+		return "ok"
+	case HashDeprecated:
+		return "deprecated"
+	case HashInsecure:
+		return "insecure"
+	default:
+		return "unknown"
+	}
+}
+
+//HashPolicy is a policy which restricts the hash functions that may be used
+type HashPolicy struct {
+	MinStrength     int  //minimum hash strength (see SetHashStrength)
+	AllowDeprecated bool //whether deprecated hash functions are accepted
+	AllowInsecure   bool //whether insecure hash functions are accepted
+}
+
+//HashInfo is information about a registered hash function
+type HashInfo struct {
+	Name     string     //canonical name
+	Aliases  []string   //alternative names
+	Strength int        //strength (see SetHashStrength)
+	Status   HashStatus //security status
+}
+
+//registry entry of a hash function
+type hashEnt struct {
+	fn       func() hash.Hash
+	strength int
+	status   HashStatus
+	merkle   *merkleParams //parameters if this is a merkle hash type
+	mhcode   uint64        //multihash code
+	hasmh    bool          //whether the multihash code is set
+}
+
+//hashRegistry is a concurrency-safe registry of hash functions
+type hashRegistry struct {
+	lck     sync.RWMutex
+	ents    map[string]*hashEnt
+	aliases map[string]string //alias -> canonical name
+	mhnames map[uint64]string //multihash code -> canonical name
+	policy  HashPolicy
+}
+
+//registry of hash functions
+var hashreg = &hashRegistry{
+	ents:    map[string]*hashEnt{},
+	aliases: map[string]string{},
+	mhnames: map[uint64]string{},
+	policy: HashPolicy{
+		AllowDeprecated: true,
+	},
+}
+
+//ErrWeakHash is an error returned when a hash type is rejected by the hash policy
+var ErrWeakHash = errors.New("Hash function rejected by policy")
+
+//canonical resolves an alias (must be called with lck held)
+func (r *hashRegistry) canonical(name string) string {
+	if c, ok := r.aliases[name]; ok {
+		return c
+	}
+	return name
+}
+
+//ent looks up an entry by name or alias (must be called with lck held)
+func (r *hashRegistry) ent(name string) *hashEnt {
+	return r.ents[r.canonical(name)]
+}
+
+//register adds or updates an entry
+func (r *hashRegistry) register(name string, fn func() hash.Hash, merkle *merkleParams) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	delete(r.aliases, name)
+	e := r.ents[name]
+	if e == nil {
+		e = new(hashEnt)
+		r.ents[name] = e
+	}
+	e.fn = fn
+	e.merkle = merkle
+}
+
+//unregister removes an entry along with its aliases and multihash code
+func (r *hashRegistry) unregister(name string) {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	c := r.canonical(name)
+	e := r.ents[c]
+	if e == nil {
+		return
+	}
+	delete(r.ents, c)
+	for a, n := range r.aliases {
+		if n == c {
+			delete(r.aliases, a)
+		}
+	}
+	if e.hasmh && r.mhnames[e.mhcode] == c {
+		delete(r.mhnames, e.mhcode)
+	}
+}
+
+//update modifies an entry
+func (r *hashRegistry) update(name string, fn func(*hashEnt)) error {
+	r.lck.Lock()
+	defer r.lck.Unlock()
+	e := r.ent(name)
+	if e == nil {
+		return ErrUnrecognizedHash
+	}
+	fn(e)
+	return nil
+}
+
+//lookup gets a copy of an entry along with its canonical name
+func (r *hashRegistry) lookup(name string) (hashEnt, string, bool) {
+	r.lck.RLock()
+	defer r.lck.RUnlock()
+	c := r.canonical(name)
+	e := r.ents[c]
+	if e == nil {
+		return hashEnt{}, "", false
+	}
+	return *e, c, true
+}
+
+//check checks an entry against the policy (must be called with lck held)
+func (r *hashRegistry) check(e *hashEnt) error {
+	switch {
+	case e == nil:
+		return ErrUnrecognizedHash
+	case e.strength < r.policy.MinStrength:
+		return ErrWeakHash
+	case e.status == HashDeprecated && !r.policy.AllowDeprecated:
+		return ErrWeakHash
+	case e.status == HashInsecure && !r.policy.AllowInsecure:
+		return ErrWeakHash
+	default:
+		return nil
+	}
+}
+
+//hashFunc returns the hash function for a name (nil if unrecognized)
+func hashFunc(name string) func() hash.Hash {
+	e, _, ok := hashreg.lookup(name)
+	if !ok {
+		return nil
+	}
+	return e.fn
+}
+
+//merkleParamsOf returns the merkle parameters of a hash type
+func merkleParamsOf(name string) (merkleParams, bool) {
+	e, _, ok := hashreg.lookup(name)
+	if !ok || e.merkle == nil {
+		return merkleParams{}, false
+	}
+	return *e.merkle, true
+}
+
+//RegisterHash registers a hash function
+func RegisterHash(name string, fn func() hash.Hash) {
+	hashreg.register(name, fn, nil)
+}
+
+//RegisterHashAlias registers an alternative name for a hash function
+//hashes parsed with an alias use the canonical name
+func RegisterHashAlias(alias string, name string) error {
+	hashreg.lck.Lock()
+	defer hashreg.lck.Unlock()
+	c := hashreg.canonical(name)
+	if hashreg.ents[c] == nil {
+		return ErrUnrecognizedHash
+	}
+	if hashreg.ents[alias] != nil {
+		return errors.New("alias conflicts with a registered hash function")
+	}
+	hashreg.aliases[alias] = c
+	return nil
+}
+
+//SetHashStrength sets the strength of a hash function (usually collision resistance in bits)
+//this is used to pick the strongest hash when several are available, and by the hash policy
+func SetHashStrength(name string, strength int) error {
+	return hashreg.update(name, func(e *hashEnt) {
+		e.strength = strength
+	})
+}
+
+//SetHashStatus marks a hash function as ok, deprecated or insecure
+func SetHashStatus(name string, status HashStatus) error {
+	return hashreg.update(name, func(e *hashEnt) {
+		e.status = status
+	})
+}
+
+//RegisterMultihash registers the multihash code of a hash type
+func RegisterMultihash(name string, code uint64) error {
+	hashreg.lck.Lock()
+	defer hashreg.lck.Unlock()
+	c := hashreg.canonical(name)
+	e := hashreg.ents[c]
+	if e == nil {
+		return ErrUnrecognizedHash
+	}
+	e.mhcode = code
+	e.hasmh = true
+	hashreg.mhnames[code] = c
+	return nil
+}
+
+//multihashName returns the hash type with a multihash code
+func multihashName(code uint64) (string, bool) {
+	hashreg.lck.RLock()
+	defer hashreg.lck.RUnlock()
+	n, ok := hashreg.mhnames[code]
+	return n, ok
+}
+
+//SetHashPolicy sets the policy used to reject weak hash functions
+func SetHashPolicy(p HashPolicy) {
+	hashreg.lck.Lock()
+	defer hashreg.lck.Unlock()
+	hashreg.policy = p
+}
+
+//GetHashPolicy returns the current hash policy
+func GetHashPolicy() HashPolicy {
+	hashreg.lck.RLock()
+	defer hashreg.lck.RUnlock()
+	return hashreg.policy
+}
+
+//CheckHashType checks that a hash type is registered and allowed by the hash policy
+func CheckHashType(name string) error {
+	hashreg.lck.RLock()
+	defer hashreg.lck.RUnlock()
+	return hashreg.check(hashreg.ent(name))
+}
+
+//HashTypes lists the registered hash functions (sorted by name)
+func HashTypes() []HashInfo {
+	hashreg.lck.RLock()
+	defer hashreg.lck.RUnlock()
+	infos := make([]HashInfo, 0, len(hashreg.ents))
+	idx := make(map[string]int, len(hashreg.ents))
+	names := make([]string, 0, len(hashreg.ents))
+	for n := range hashreg.ents {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		e := hashreg.ents[n]
+		idx[n] = len(infos)
+		infos = append(infos, HashInfo{
+			Name:     n,
+			Strength: e.strength,
+			Status:   e.status,
+		})
+	}
+	aliases := make([]string, 0, len(hashreg.aliases))
+	for a := range hashreg.aliases {
+		aliases = append(aliases, a)
+	}
+	sort.Strings(aliases)
+	for _, a := range aliases {
+		i := idx[hashreg.aliases[a]]
+		infos[i].Aliases = append(infos[i].Aliases, a)
+	}
+	return infos
+}
@@ -0,0 +1,111 @@
+package dcdn
+
+import (
+	"crypto/sha256"
+	"hash"
+	"sync"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	//aliases resolve to the canonical name
+	h := quickHash(t, []byte("registry test"))
+	h2, err := ParseHash("sha2-256" + h.String()[len("sha256"):])
+	if err != nil {
+		t.Fatalf("Failed to parse aliased hash: %q\n", err.Error())
+	}
+	if h2.String() != h.String() {
+		t.Fatalf("Alias not resolved: %q => %q\n", h.String(), h2.String())
+	}
+	if RegisterHashAlias("x", "badhash") != ErrUnrecognizedHash {
+		t.Fatal("Expected unrecognized hash error for alias\n")
+	}
+	//listing
+	found := false
+	for _, v := range HashTypes() {
+		if v.Name == "sha256" {
+			found = true
+			if v.Strength != 128 || v.Status != HashOK || len(v.Aliases) != 1 || v.Aliases[0] != "sha2-256" {
+				t.Fatalf("Bad sha256 info: %+v\n", v)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("sha256 not listed\n")
+	}
+	//policy
+	RegisterHash("testweak", func() hash.Hash {
+		return sha256.New()
+	})
+	defer hashreg.unregister("testweak")
+	defer SetHashPolicy(GetHashPolicy())
+	weak := Hash{HashType: "testweak", Hash: h.Hash, Len: h.Len}
+	if _, err = weak.Verifier(); err != nil {
+		t.Fatalf("Unexpected error with default policy: %q\n", err.Error())
+	}
+	SetHashStatus("testweak", HashInsecure)
+	if _, err = weak.Verifier(); err != ErrWeakHash {
+		t.Fatalf("Expected weak hash error but got %v\n", err)
+	}
+	h2, err = ParseHash(weak.String())
+	testErr(t, h2, err, ErrWeakHash)
+	SetHashStatus("testweak", HashDeprecated)
+	SetHashPolicy(HashPolicy{MinStrength: 200})
+	if CheckHashType("testweak") != ErrWeakHash || CheckHashType("sha256") != ErrWeakHash {
+		t.Fatal("Expected weak hash errors\n")
+	}
+	if CheckHashType("sha512") != nil {
+		t.Fatal("sha512 rejected by policy\n")
+	}
+	if s := StrongestHash([]*Hash{&h, &weak}); s != nil {
+		t.Fatalf("Expected no acceptable hash but got %v\n", s)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	h := quickHash(t, []byte("concurrent"))
+	hstr := h.String()
+	defer hashreg.unregister("testconcurrent")
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				RegisterHash("testconcurrent", func() hash.Hash {
+					return sha256.New()
+				})
+				SetHashStrength("testconcurrent", j)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := ParseHash(hstr)
+				if err != nil {
+					t.Errorf("Failed to parse hash: %q\n", err.Error())
+				}
+				HashTypes()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRegistryUnregister(t *testing.T) {
+	RegisterHash("testtmp", func() hash.Hash {
+		return sha256.New()
+	})
+	if err := RegisterHashAlias("testtmp-alias", "testtmp"); err != nil {
+		t.Fatalf("Failed to register alias: %q\n", err.Error())
+	}
+	hashreg.unregister("testtmp-alias")
+	if CheckHashType("testtmp") != ErrUnrecognizedHash || CheckHashType("testtmp-alias") != ErrUnrecognizedHash {
+		t.Fatal("Hash type still registered\n")
+	}
+	for _, v := range HashTypes() {
+		if v.Name == "testtmp" {
+			t.Fatalf("Hash type still listed: %+v\n", v)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package dcdn
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//maximum number of shards in a HashCache
+const maxShards = 64
+
+//minimum number of entries per shard when the number of entries is limited
+//eviction only considers the entries of one shard, so shards must not be too small
+const minShardEntries = 64
+
+//hcShard is a part of the HashCache entry table
+type hcShard struct {
+	lck  sync.Mutex
+	ents map[string]*hcEnt
+	ev   evictor
+	max  int //maximum number of entries (0 for no limit)
+}
+
+//initShards creates the entry table shards
+func (hc *HashCache) initShards() {
+	n := maxShards
+	if max := hc.opts.MaxEntries; max > 0 {
+		n = max / minShardEntries
+		if n > maxShards {
+			n = maxShards
+		}
+		if n < 1 {
+			n = 1
+		}
+	}
+	hc.shards = make([]hcShard, n)
+	for i := range hc.shards {
+		sh := &hc.shards[i]
+		sh.ents = make(map[string]*hcEnt)
+		sh.ev = newEvictor(hc.opts.Eviction)
+		if max := hc.opts.MaxEntries; max > 0 {
+			//spread the limit over the shards
+			sh.max = max / n
+			if i < max%n {
+				sh.max++
+			}
+		}
+	}
+}
+
+//shard selects the shard of a path (FNV-1a)
+func (hc *HashCache) shard(name string) *hcShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		h ^= uint32(name[i])
+		h *= 16777619
+	}
+	return &hc.shards[h%uint32(len(hc.shards))]
+}
+
+//remove removes an entry from the shard (must be called with sh.lck held)
+//the hashes of the entry are removed from the reverse index, unless they are kept in the persistent index
+func (sh *hcShard) remove(hc *HashCache, he *hcEnt) {
+	sh.ev.remove(he)
+	delete(sh.ents, he.file)
+	atomic.AddInt64(&hc.stats.entries, -1)
+	if hc.index == nil {
+		hc.hlck.Lock()
+		hc.unindex(he)
+		he.removed = true
+		hc.hlck.Unlock()
+	}
+}
+
+//get finds an entry in the shard (must be called with sh.lck held)
+func (sh *hcShard) get(name string) *hcEnt {
+	he := sh.ents[name]
+	if he != nil {
+		sh.ev.touch(he)
+	}
+	return he
+}
+
+//lookup finds the cache entry for a path, creating it if necessary
+//concurrent requests for the same file share the entry, and the entry lock makes sure that the file is only hashed once
+func (hc *HashCache) lookup(path string) (*hcEnt, error) {
+	name := cleanPath(path)
+	sh := hc.shard(name)
+	sh.lck.Lock()
+	he := sh.get(name)
+	sh.lck.Unlock()
+	if he != nil {
+		return he, nil
+	}
+	//check the file without holding the shard lock
+	_, err := hc.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	sh.lck.Lock()
+	defer sh.lck.Unlock()
+	if he = sh.get(name); he != nil { //created concurrently
+		return he, nil
+	}
+	if sh.max > 0 && len(sh.ents) >= sh.max { //make room
+		sh.remove(hc, sh.ev.victim())
+		atomic.AddUint64(&hc.stats.evictions, 1)
+	}
+	he = new(hcEnt)
+	he.file = name
+	he.lastused = time.Now()
+	sh.ents[name] = he
+	sh.ev.add(he)
+	atomic.AddInt64(&hc.stats.entries, 1)
+	return he, nil
+}
+
+//find finds the cache entry for a path without creating it (nil if it is not cached)
+func (hc *HashCache) find(name string) *hcEnt {
+	sh := hc.shard(name)
+	sh.lck.Lock()
+	defer sh.lck.Unlock()
+	return sh.ents[name]
+}
+
+//invalidateTree invalidates the entries of all files under a directory ("/" for all entries)
+func (hc *HashCache) invalidateTree(dir string) {
+	var ents []*hcEnt
+	for i := range hc.shards {
+		sh := &hc.shards[i]
+		sh.lck.Lock()
+		for name, he := range sh.ents {
+			if dir == "/" || name == dir || strings.HasPrefix(name, dir+"/") {
+				ents = append(ents, he)
+			}
+		}
+		sh.lck.Unlock()
+	}
+	for _, he := range ents {
+		he.invalidate(hc)
+	}
+}
+
+//pruner periodically removes entries which have not been used for longer than the TTL
+func (hc *HashCache) pruner() {
+	ttl := hc.opts.TTL
+	interval := time.Minute
+	if ttl < interval {
+		interval = ttl
+	}
+	prunetimer := time.NewTicker(interval)
+	defer prunetimer.Stop()
+	for {
+		select {
+		case <-prunetimer.C:
+			for i := range hc.shards {
+				sh := &hc.shards[i]
+				sh.lck.Lock()
+				for _, v := range sh.ents {
+					if v.shouldPrune(ttl) {
+						sh.remove(hc, v)
+						atomic.AddUint64(&hc.stats.expirations, 1)
+					}
+				}
+				sh.lck.Unlock()
+			}
+		case <-hc.done:
+			return
+		}
+	}
+}
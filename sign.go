@@ -0,0 +1,58 @@
+package dcdn
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//ErrBadSignature is an error returned when a hash signature is missing or invalid
+var ErrBadSignature = errors.New("Invalid hash signature")
+
+//ErrSignatureExpired is an error returned when a hash signature has expired
+var ErrSignatureExpired = errors.New("Hash signature expired")
+
+//sigMessage builds the message which is signed for a hash
+//the scheme, host, path and query of the URL are all signed, so that a signature can not be replayed for another origin or query
+func sigMessage(h Hash, u *url.URL, expiry int64) []byte {
+	return []byte(fmt.Sprintf("dcdn-sig-v2\n%s\n%s\n%s\n%s\n%s\n%d",
+		h.String(), strings.ToLower(u.Scheme), strings.ToLower(u.Host), u.Path, u.RawQuery, expiry))
+}
+
+//SignHash signs a hash served at a URL (format expiryunix:signaturebase64)
+func SignHash(key ed25519.PrivateKey, h Hash, u *url.URL, expiry time.Time) string {
+	exp := expiry.Unix()
+	sig := ed25519.Sign(key, sigMessage(h, u, exp))
+	return fmt.Sprintf("%d:%s", exp, base64.StdEncoding.EncodeToString(sig))
+}
+
+//VerifyHashSignature checks a signature created by SignHash against a set of trusted keys
+func VerifyHashSignature(keys []ed25519.PublicKey, sig string, h Hash, u *url.URL) error {
+	parts := strings.Split(sig, ":")
+	if len(parts) != 2 {
+		return ErrBadSignature
+	}
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	sdat, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ErrBadSignature
+	}
+	msg := sigMessage(h, u, exp)
+	for _, k := range keys {
+		if ed25519.Verify(k, msg, sdat) {
+			if time.Now().Unix() > exp {
+				return ErrSignatureExpired
+			}
+			return nil
+		}
+	}
+	return ErrBadSignature
+}
@@ -0,0 +1,139 @@
+package dcdn
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignHash(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %q\n", err.Error())
+	}
+	otherpub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %q\n", err.Error())
+	}
+	h := quickHash(t, []byte("signed content"))
+	u := &url.URL{Scheme: "https", Host: "example.com", Path: "/file.txt", RawQuery: "v=1"}
+	sig := SignHash(priv, h, u, time.Now().Add(time.Minute))
+	//good signature
+	err = VerifyHashSignature([]ed25519.PublicKey{otherpub, pub}, sig, h, u)
+	if err != nil {
+		t.Fatalf("Unexpected signature error: %q\n", err.Error())
+	}
+	//untrusted key
+	err = VerifyHashSignature([]ed25519.PublicKey{otherpub}, sig, h, u)
+	if err != ErrBadSignature {
+		t.Fatalf("Expected bad signature error but got %v\n", err)
+	}
+	//the host and scheme are not case sensitive
+	err = VerifyHashSignature([]ed25519.PublicKey{pub}, sig, h, &url.URL{Scheme: "HTTPS", Host: "Example.com", Path: "/file.txt", RawQuery: "v=1"})
+	if err != nil {
+		t.Fatalf("Unexpected signature error: %q\n", err.Error())
+	}
+	//different URL
+	for _, o := range []*url.URL{
+		{Scheme: "https", Host: "example.com", Path: "/other.txt", RawQuery: "v=1"},
+		{Scheme: "https", Host: "example.org", Path: "/file.txt", RawQuery: "v=1"},
+		{Scheme: "http", Host: "example.com", Path: "/file.txt", RawQuery: "v=1"},
+		{Scheme: "https", Host: "example.com", Path: "/file.txt", RawQuery: "v=2"},
+		{Scheme: "https", Host: "example.com", Path: "/file.txt"},
+	} {
+		err = VerifyHashSignature([]ed25519.PublicKey{pub}, sig, h, o)
+		if err != ErrBadSignature {
+			t.Fatalf("[%s] Expected bad signature error but got %v\n", o, err)
+		}
+	}
+	//different hash
+	err = VerifyHashSignature([]ed25519.PublicKey{pub}, sig, quickHash(t, []byte("forged content")), u)
+	if err != ErrBadSignature {
+		t.Fatalf("Expected bad signature error but got %v\n", err)
+	}
+	//missing or malformed signature
+	for _, s := range []string{"", "123", "x:y", "123:!!"} {
+		err = VerifyHashSignature([]ed25519.PublicKey{pub}, s, h, u)
+		if err != ErrBadSignature {
+			t.Fatalf("Expected bad signature error for %q but got %v\n", s, err)
+		}
+	}
+	//expired signature
+	sig = SignHash(priv, h, u, time.Now().Add(-time.Minute))
+	err = VerifyHashSignature([]ed25519.PublicKey{pub}, sig, h, u)
+	if err != ErrSignatureExpired {
+		t.Fatalf("Expected signature expired error but got %v\n", err)
+	}
+}
+
+func TestSignedResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnsign")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file.txt"), []byte("signed content"), 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %q\n", err.Error())
+	}
+	srv := httptest.NewServer(FileServer{HashCache: hc, SigningKey: priv, ErrLogger: func(error) {}})
+	defer srv.Close()
+	cli := NewClient()
+	defer cli.Close()
+	cli.SetOriginKeys(pub)
+	u, _ := url.Parse(srv.URL + "/file.txt?v=1")
+	resp, h, err := cli.Get(u)
+	if err != nil || h == nil {
+		t.Fatalf("Signed response rejected: %v\n", err)
+	}
+	resp.Body.Close()
+	//all signed hashes are returned, and unsigned ones are dropped
+	hc.SetHashTypes("sha256", "sha512")
+	raw, err := http.Get(u.String())
+	if err != nil {
+		t.Fatalf("Request failed: %q\n", err.Error())
+	}
+	raw.Body.Close()
+	if hashes := cli.ResponseHashes(raw, u); len(hashes) != 2 {
+		t.Fatalf("Expected 2 signed hashes but got %v\n", hashes)
+	}
+	sigs := raw.Header.Values("X-DCDN-Signature")
+	raw.Header.Del("X-DCDN-Signature")
+	raw.Header.Add("X-DCDN-Signature", sigs[0])
+	if hashes := cli.ResponseHashes(raw, u); len(hashes) != 1 || hashes[0].HashType != "sha256" {
+		t.Fatalf("Expected only the signed sha256 hash but got %v\n", hashes)
+	}
+	//a signature replayed for another query is rejected
+	replay := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := http.Get(srv.URL + "/file.txt?v=1")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for _, k := range []string{"X-DCDN", "X-DCDN-HASH", "X-DCDN-Signature"} {
+			for _, v := range resp.Header.Values(k) {
+				w.Header().Add(k, v)
+			}
+		}
+		w.Write([]byte("signed content"))
+	}))
+	defer replay.Close()
+	u, _ = url.Parse(replay.URL + "/file.txt?v=2")
+	_, _, err = cli.Get(u)
+	if err != ErrBadSignature {
+		t.Fatalf("Expected bad signature error but got %v\n", err)
+	}
+}
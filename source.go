@@ -0,0 +1,43 @@
+package dcdn
+
+import (
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+//cleanPath cleans a slash-separated path relative to the content root (the result always starts with a slash)
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+//fsName converts a slash-separated path relative to the content root to an fs.FS name
+func fsName(p string) string {
+	name := strings.TrimPrefix(cleanPath(p), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+//fileSection returns a reader for a section of an opened file
+//files which do not support random access are read sequentially up to the section
+func fileSection(f fs.File, off int64, n int64) (io.Reader, error) {
+	if ra, ok := f.(io.ReaderAt); ok {
+		return io.NewSectionReader(ra, off, n), nil
+	}
+	if sk, ok := f.(io.Seeker); ok {
+		_, err := sk.Seek(off, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		_, err := io.CopyN(ioutil.Discard, f, off)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return io.LimitReader(f, n), nil
+}
@@ -0,0 +1,127 @@
+package dcdn
+
+import (
+	"context"
+	"io/fs"
+	"runtime"
+	"sync"
+)
+
+//WarmProgress is a progress report from a warm-up scan
+type WarmProgress struct {
+	Path  string //path of the file (or directory) which was just processed
+	Err   error  //error hashing the file or reading the directory (nil on success)
+	Done  int    //number of files processed so far
+	Found int    //number of files found so far (the scan may not be complete)
+	Bytes uint64 //number of bytes hashed so far
+}
+
+//WarmOptions are options for a warm-up scan
+type WarmOptions struct {
+	Workers  int                //number of files to hash concurrently (default GOMAXPROCS)
+	Progress func(WarmProgress) //called after each file (calls are serialized, may be nil)
+}
+
+//WarmResult is the result of a warm-up scan
+type WarmResult struct {
+	Files  int              //number of files hashed successfully
+	Bytes  uint64           //number of bytes hashed
+	Errors map[string]error //files which could not be hashed and directories which could not be read
+}
+
+//Warm walks the content source and precomputes hashes of all regular files
+//errors with individual files are collected in the result and do not stop the scan
+//warmed hashes expire like any others when they are not used for the TTL (or are evicted), so use a persistent Index (or disable the TTL) to keep them
+func (hc *HashCache) Warm(ctx context.Context) (*WarmResult, error) {
+	return hc.WarmWith(ctx, WarmOptions{})
+}
+
+//WarmWith is like Warm but with options
+func (hc *HashCache) WarmWith(ctx context.Context, opts WarmOptions) (*WarmResult, error) {
+	workers := opts.Workers
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	res := &WarmResult{
+		Errors: make(map[string]error),
+	}
+	var lck sync.Mutex
+	var prog WarmProgress
+	report := func(path string, h *Hash, err error) {
+		lck.Lock()
+		defer lck.Unlock()
+		prog.Path, prog.Err = path, err
+		prog.Done++
+		if err != nil {
+			res.Errors[path] = err
+		} else {
+			res.Files++
+			res.Bytes += h.Len
+			prog.Bytes = res.Bytes
+		}
+		if opts.Progress != nil {
+			opts.Progress(prog)
+		}
+	}
+	//start workers
+	jobs := make(chan string, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range jobs {
+				h, err := hc.warmFile(p)
+				report(p, h, err)
+			}
+		}()
+	}
+	//walk the content
+	err := fs.WalkDir(hc.fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p := cleanPath(name)
+		if err != nil {
+			if name == "." {
+				return err
+			}
+			report(p, nil, err)
+			return nil
+		}
+		if !hc.opts.Paths.AllowHidden && hidden(name) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		lck.Lock()
+		prog.Found++
+		lck.Unlock()
+		select {
+		case jobs <- p:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(jobs)
+	wg.Wait()
+	return res, err
+}
+
+//warmFile hashes a single file
+func (hc *HashCache) warmFile(path string) (*Hash, error) {
+	he, err := hc.lookup(path)
+	if err != nil {
+		return nil, err
+	}
+	hashes, _, err := he.getHashes(hc)
+	if err != nil {
+		return nil, err
+	}
+	return hashes[0], nil
+}
@@ -0,0 +1,111 @@
+package dcdn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestHashCacheWarm(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnwarm")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 20; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("d%d", i%3))
+		os.MkdirAll(sub, 0700)
+		ioutil.WriteFile(filepath.Join(sub, fmt.Sprintf("f%d", i)), []byte(fmt.Sprintf("file %d", i)), 0600)
+	}
+	//unreadable file (permissions are ignored when running as root)
+	bad := filepath.Join(dir, "unreadable")
+	ioutil.WriteFile(bad, []byte("secret"), 0)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	calls := 0
+	res, err := hc.WarmWith(context.Background(), WarmOptions{
+		Workers: 3,
+		Progress: func(p WarmProgress) {
+			calls++
+			if p.Done != calls {
+				t.Errorf("Progress out of order: %d != %d\n", p.Done, calls)
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Warm failed: %q\n", err.Error())
+	}
+	if calls != 21 {
+		t.Fatalf("Expected 21 progress reports but got %d\n", calls)
+	}
+	if os.Geteuid() != 0 {
+		if res.Files != 20 || len(res.Errors) != 1 || res.Errors["/unreadable"] == nil {
+			t.Fatalf("Unexpected warm result: %+v\n", res)
+		}
+	} else if res.Files+len(res.Errors) != 21 {
+		t.Fatalf("Unexpected warm result: %+v\n", res)
+	}
+	//hashes should now be cached
+	f, h, _, err := hc.Get("/d1/f1")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	if h.String() != quickHash(t, []byte("file 1")).String() {
+		t.Fatalf("Bad hash after warm: %q\n", h.String())
+	}
+	//cancelled scan
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = hc.Warm(ctx)
+	if err != context.Canceled {
+		t.Fatalf("Expected context cancelled error but got %v\n", err)
+	}
+}
+
+//badDirFS is an fs.FS where one directory can not be read
+type badDirFS struct {
+	fstest.MapFS
+	bad string
+}
+
+func (b badDirFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == b.bad {
+		return nil, errors.New("unreadable directory")
+	}
+	return b.MapFS.ReadDir(name)
+}
+
+func TestHashCacheWarmDirError(t *testing.T) {
+	hc, err := NewHashCacheFS(badDirFS{fstest.MapFS{
+		"ok/f":  &fstest.MapFile{Data: []byte("ok")},
+		"bad/f": &fstest.MapFile{Data: []byte("bad")},
+	}, "bad"}, HashCacheOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	var reported error
+	res, err := hc.WarmWith(context.Background(), WarmOptions{
+		Progress: func(p WarmProgress) {
+			if p.Path == "/bad" {
+				reported = p.Err
+			}
+		},
+	})
+	if err != nil {
+		t.Fatalf("Warm failed: %q\n", err.Error())
+	}
+	if reported == nil || res.Files != 1 || res.Errors["/bad"] == nil {
+		t.Fatalf("Directory error not reported: %v %+v\n", reported, res)
+	}
+}
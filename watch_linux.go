@@ -0,0 +1,129 @@
+package dcdn
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+//events which indicate that a file may have changed
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_DELETE | syscall.IN_ATTRIB | syscall.IN_CREATE | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+//dirWatcher watches a directory tree with inotify
+type dirWatcher struct {
+	lck  sync.Mutex
+	f    *os.File
+	root string
+	wds  map[int32]string //watch descriptor -> directory path relative to root
+}
+
+func newDirWatcher(root string) (*dirWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &dirWatcher{
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		root: root,
+		wds:  make(map[int32]string),
+	}
+	err = w.addTree("")
+	if err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+//addTree watches a directory and all subdirectories
+func (w *dirWatcher) addTree(rel string) error {
+	return filepath.Walk(filepath.Join(w.root, rel), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path != w.root && os.IsNotExist(err) {
+				return nil //removed while walking
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		r, err := filepath.Rel(w.root, path)
+		if err != nil {
+			return err
+		}
+		wd, err := syscall.InotifyAddWatch(int(w.f.Fd()), path, watchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.lck.Lock()
+		w.wds[int32(wd)] = r
+		w.lck.Unlock()
+		return nil
+	})
+}
+
+//run reads events and calls fn with the slash-separated path (relative to root) of each changed file
+//tree is set if everything under the path may have changed (a directory was moved or removed, or events were lost)
+//it returns when the watcher is closed
+func (w *dirWatcher) run(fn func(p string, tree bool)) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		dat := buf[:n]
+		for len(dat) >= syscall.SizeofInotifyEvent {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&dat[0]))
+			wd, mask := ev.Wd, ev.Mask
+			end := syscall.SizeofInotifyEvent + int(ev.Len)
+			if end > len(dat) {
+				break
+			}
+			name := string(bytes.TrimRight(dat[syscall.SizeofInotifyEvent:end], "\x00"))
+			dat = dat[end:]
+			if mask&syscall.IN_Q_OVERFLOW != 0 {
+				//events were lost - anything may have changed
+				fn("/", true)
+				continue
+			}
+			w.lck.Lock()
+			dir, ok := w.wds[wd]
+			if mask&syscall.IN_IGNORED != 0 {
+				delete(w.wds, wd)
+			}
+			w.lck.Unlock()
+			if !ok {
+				continue
+			}
+			if name == "" {
+				if mask&(syscall.IN_DELETE_SELF|syscall.IN_MOVE_SELF) != 0 {
+					//watched directory moved or removed (also reported to the parent, except for the root)
+					fn("/"+filepath.ToSlash(dir), true)
+				}
+				continue
+			}
+			rel := filepath.Join(dir, name)
+			if mask&syscall.IN_ISDIR != 0 {
+				if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					w.addTree(rel)
+				}
+				if mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO|syscall.IN_DELETE) != 0 {
+					//every file under the directory was replaced or removed
+					fn("/"+filepath.ToSlash(rel), true)
+				}
+				continue
+			}
+			fn("/"+filepath.ToSlash(rel), false)
+		}
+	}
+}
+
+//close stops the watcher
+func (w *dirWatcher) close() error {
+	return w.f.Close()
+}
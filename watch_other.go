@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package dcdn
+
+//dirWatcher is not supported on this platform
+type dirWatcher struct{}
+
+func newDirWatcher(root string) (*dirWatcher, error) {
+	return nil, ErrWatchUnsupported
+}
+
+func (w *dirWatcher) run(fn func(p string, tree bool)) {}
+
+func (w *dirWatcher) close() error {
+	return nil
+}
@@ -0,0 +1,167 @@
+package dcdn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHashCacheWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnwatch")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	fpath := filepath.Join(dir, "sub", "file")
+	ioutil.WriteFile(fpath, []byte("version 1"), 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	err = hc.Watch()
+	if err == ErrWatchUnsupported {
+		t.Skip("Filesystem watching not supported\n")
+	}
+	if err != nil {
+		t.Fatalf("Failed to watch: %q\n", err.Error())
+	}
+	get := func() string {
+		f, h, _, err := hc.Get("/sub/file")
+		if err != nil {
+			t.Fatalf("Failed to get file: %q\n", err.Error())
+		}
+		f.Close()
+		return h.String()
+	}
+	if get() != quickHash(t, []byte("version 1")).String() {
+		t.Fatal("Wrong initial hash\n")
+	}
+	//rewrite the file and wait for the background rehash
+	ioutil.WriteFile(fpath, []byte("version 2"), 0600)
+	expect := quickHash(t, []byte("version 2")).String()
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != expect {
+		if time.Now().After(deadline) {
+			t.Fatal("Hash was not updated after file change\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHashCacheWatchDirMove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnwatch")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("old deploy"), 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	err = hc.Watch()
+	if err == ErrWatchUnsupported {
+		t.Skip("Filesystem watching not supported\n")
+	}
+	if err != nil {
+		t.Fatalf("Failed to watch: %q\n", err.Error())
+	}
+	get := func() string {
+		_, h, err := hc.GetChunks("/sub/file")
+		if err != nil {
+			t.Fatalf("Failed to get chunks: %q\n", err.Error())
+		}
+		return h.String()
+	}
+	if get() != quickHash(t, []byte("old deploy")).String() {
+		t.Fatal("Wrong initial hash\n")
+	}
+	//replace the whole directory (no event for the file itself)
+	os.Mkdir(filepath.Join(dir, "new"), 0700)
+	ioutil.WriteFile(filepath.Join(dir, "new", "file"), []byte("new deploy"), 0600)
+	os.Rename(filepath.Join(dir, "sub"), filepath.Join(dir, "old"))
+	os.Rename(filepath.Join(dir, "new"), filepath.Join(dir, "sub"))
+	expect := quickHash(t, []byte("new deploy")).String()
+	deadline := time.Now().Add(5 * time.Second)
+	for get() != expect {
+		if time.Now().After(deadline) {
+			t.Fatal("Hash was not updated after the directory was replaced\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHashCacheWatchWaitsForRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnwatch")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "file")
+	ioutil.WriteFile(fpath, []byte("version 1"), 0600)
+	hc, err := NewHashCache(dir)
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	hc.watcher = new(dirWatcher) //pretend to watch, and run the background refresh by hand
+	f, _, _, err := hc.GetAll("/file")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	//replace the file and queue the refresh like the watcher does
+	tmp := filepath.Join(dir, "tmp")
+	ioutil.WriteFile(tmp, []byte("version 2"), 0600)
+	os.Rename(tmp, fpath)
+	he, err := hc.lookup("/file")
+	if err != nil {
+		t.Fatalf("Failed to look up entry: %q\n", err.Error())
+	}
+	hc.queueRefresh(he)
+	<-hc.rch //no workers are running
+	//large files are served without hashes while the refresh is pending
+	f, hashes, _, err := hc.GetAllAsync("/file", 0)
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	if hashes != nil {
+		t.Fatalf("Expected no hashes while refreshing but got %v\n", hashes)
+	}
+	//GetAll waits for the refresh instead of hashing the file itself
+	type result struct {
+		hashes []*Hash
+		err    error
+	}
+	res := make(chan result, 1)
+	go func() {
+		f, hashes, _, err := hc.GetAll("/file")
+		if err == nil {
+			f.Close()
+		}
+		res <- result{hashes, err}
+	}()
+	select {
+	case r := <-res:
+		t.Fatalf("GetAll did not wait for the refresh: %v %v\n", r.hashes, r.err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	he.refresh(hc)
+	r := <-res
+	if r.err != nil {
+		t.Fatalf("Failed to get file: %q\n", r.err.Error())
+	}
+	if r.hashes[0].String() != quickHash(t, []byte("version 2")).String() {
+		t.Fatalf("Wrong hash after refresh: %v\n", r.hashes[0])
+	}
+	if st := hc.Stats(); st.Hits != 0 || st.Misses != 2 {
+		t.Fatalf("Expected 0 hits and 2 misses but got %d and %d\n", st.Hits, st.Misses)
+	}
+}
@@ -0,0 +1,13 @@
+package dcdn
+
+import "syscall"
+
+//readXattr reads an extended attribute of a file ("" if it is not set)
+func readXattr(fpath string, name string) string {
+	buf := make([]byte, 256)
+	n, err := syscall.Getxattr(fpath, name, buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
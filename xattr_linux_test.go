@@ -0,0 +1,38 @@
+package dcdn
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestPrecomputedXattr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dcdnxattr")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %q\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	fpath := filepath.Join(dir, "file")
+	ioutil.WriteFile(fpath, []byte("content"), 0600)
+	fake := quickHash(t, []byte("other"))
+	if err := syscall.Setxattr(fpath, "user.dcdn.sha256", []byte(hex.EncodeToString(fake.Hash)+"\n"), 0); err != nil {
+		t.Skipf("Extended attributes not supported: %q\n", err.Error())
+	}
+	hc, err := NewHashCacheWithOptions(dir, HashCacheOptions{Precomputed: PrecomputedXattr})
+	if err != nil {
+		t.Fatalf("Failed to create hash cache: %q\n", err.Error())
+	}
+	defer hc.Close()
+	f, h, _, err := hc.Get("/file")
+	if err != nil {
+		t.Fatalf("Failed to get file: %q\n", err.Error())
+	}
+	f.Close()
+	fake.Len = 7
+	if h.String() != fake.String() {
+		t.Fatalf("Extended attribute hash not used: %q\n", h.String())
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package dcdn
+
+//readXattr reads an extended attribute of a file (not supported on this platform)
+func readXattr(fpath string, name string) string {
+	return ""
+}